@@ -1,28 +1,4 @@
+-- Tables are created and upgraded by the backend's migrations
+-- (src/migrations/clickhouse), and the backend creates its configured
+-- database itself; this only creates the default one on first start.
 CREATE DATABASE IF NOT EXISTS sentinel;
-
-CREATE TABLE IF NOT EXISTS sentinel.events (
-    Timestamp DateTime,
-    SiteID String,
-    ClientIP String,
-    URL String,
-    Referrer String,
-    ScreenWidth UInt16,
-    Browser String,
-    OS String,
-    Country String,
-    TrustScore UInt8,
-    LCP Nullable(Float64),
-    CLS Nullable(Float64),
-    FID Nullable(Float64)
-) ENGINE = MergeTree()
-ORDER BY (SiteID, Timestamp);
-
-ALTER TABLE sentinel.events ADD COLUMN IF NOT EXISTS TrustScore UInt8;
-
-CREATE TABLE IF NOT EXISTS sentinel.session_events (
-    Timestamp DateTime,
-    SiteID String,
-    SessionID String,
-    Payload String
-) ENGINE = MergeTree()
-ORDER BY (SiteID, SessionID, Timestamp);
@@ -1,8 +1,14 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	_ "sentinel-backend/docs"
 	sentinel "sentinel-backend/src"
@@ -26,10 +32,23 @@ import (
 // @host localhost:6060
 // @BasePath /
 func main() {
+	cfg, err := sentinel.LoadConfig()
+	if err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := sentinel.MigrateCommand(os.Args[2:]); err != nil {
+			log.Fatalf("migrate: %v", err)
+		}
+		return
+	}
+
 	// All functions from your library are now prefixed with 'sentinel.'
 	sentinel.InitDB()
 	sentinel.InitAnalyticsEngine()
 	sentinel.InitClickHouse()
+	sentinel.StartIngestion()
 
 	mux := http.NewServeMux()
 
@@ -48,7 +67,7 @@ func main() {
 
 	// Strict CORS for the dashboard and API
 	apiCors := cors.New(cors.Options{
-		AllowedOrigins:   []string{"https://sentinel-mvp.getmusterup.com", "https://sentinel.getmusterup.com", "http://localhost:5173"},
+		AllowedOrigins:   cfg.CORSOrigins,
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
 		AllowedHeaders:   []string{"Content-Type", "Authorization"},
 		AllowCredentials: true,
@@ -60,23 +79,56 @@ func main() {
 	mux.Handle("/track", trackCors.Handler(http.HandlerFunc(sentinel.TrackHandler)))
 	mux.Handle("/session", trackCors.Handler(http.HandlerFunc(sentinel.SessionHandler)))
 	mux.Handle("/api/session", trackCors.Handler(http.HandlerFunc(sentinel.SessionHandler)))
+	mux.HandleFunc("/healthz", sentinel.HealthzHandler)
+	mux.HandleFunc("/readyz", sentinel.ReadyzHandler)
 	mux.Handle("/api/users", apiCors.Handler(http.HandlerFunc(sentinel.GetAllUsersHandler)))
 
 	// --- Protected API Routes ---
+	mux.Handle("/ingest/status", apiCors.Handler(sentinel.AuthMiddleware(sentinel.IngestStatusHandler)))
 	mux.Handle("/logout", apiCors.Handler(sentinel.AuthMiddleware(sentinel.LogoutHandler)))
+	mux.Handle("/logout/all", apiCors.Handler(sentinel.AuthMiddleware(sentinel.LogoutAllHandler)))
 	mux.Handle("/api/sites/", apiCors.Handler(sentinel.AuthMiddleware(sentinel.SitesApiHandler)))
-	mux.Handle("/api/dashboard", apiCors.Handler(sentinel.AuthMiddleware(sentinel.DashboardApiHandler)))
-	mux.Handle("/api/firewall", apiCors.Handler(sentinel.AuthMiddleware(sentinel.FirewallApiHandler)))
+	mux.Handle("/api/dashboard", apiCors.Handler(sentinel.APIAuthMiddleware(sentinel.DashboardApiHandler)))
+	mux.Handle("/api/events", apiCors.Handler(sentinel.APIAuthMiddleware(sentinel.EventsBreakdownHandler)))
+	mux.Handle("/api/timeseries", apiCors.Handler(sentinel.APIAuthMiddleware(sentinel.TimeseriesApiHandler)))
+	mux.Handle("/api/firewall", apiCors.Handler(sentinel.APIAuthMiddleware(sentinel.FirewallApiHandler)))
+	mux.Handle("/api/firewall/bans", apiCors.Handler(sentinel.APIAuthMiddleware(sentinel.FirewallBansApiHandler)))
+	mux.Handle("/api/firewall/log", apiCors.Handler(sentinel.APIAuthMiddleware(sentinel.FirewallLogApiHandler)))
+	mux.Handle("/api/firewall/import", apiCors.Handler(sentinel.APIAuthMiddleware(sentinel.FirewallImportApiHandler)))
+	mux.Handle("/api/firewall/export", apiCors.Handler(sentinel.APIAuthMiddleware(sentinel.FirewallExportApiHandler)))
+	mux.Handle("/api/firewall/blocklists", apiCors.Handler(sentinel.APIAuthMiddleware(sentinel.FirewallBlocklistsApiHandler)))
+	mux.Handle("/api/firewall/blocklists/sync", apiCors.Handler(sentinel.APIAuthMiddleware(sentinel.FirewallBlocklistSyncApiHandler)))
 	mux.Handle("/api/session/events", apiCors.Handler(sentinel.AuthMiddleware(sentinel.GetSessionEventsHandler)))
 	mux.Handle("/api/sessions", apiCors.Handler(sentinel.AuthMiddleware(sentinel.ListSessionsHandler)))
-	mux.Handle("/api/funnels/", apiCors.Handler(sentinel.AuthMiddleware(sentinel.FunnelsApiHandler)))
+	mux.Handle("/api/funnels/", apiCors.Handler(sentinel.APIAuthMiddleware(sentinel.FunnelsApiHandler)))
+	mux.Handle("/api/goals", apiCors.Handler(sentinel.APIAuthMiddleware(sentinel.GoalsApiHandler)))
 
 	// Swagger documentation
 	mux.HandleFunc("/docs/", httpSwagger.WrapHandler)
 
-	log.Println("Sentinel Go server starting on :6060")
-	if err := http.ListenAndServe(":6060", mux); err != nil {
-		log.Fatalf("Could not start server: %s\n", err)
+	srv := &http.Server{Addr: cfg.ListenAddr, Handler: mux}
+	go func() {
+		log.Printf("Sentinel Go server starting on %s", cfg.ListenAddr)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Could not start server: %s\n", err)
+		}
+	}()
+
+	// Stop taking traffic, drain in-flight requests, then flush queued analytics
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	<-sigs
+	log.Println("Shutting down...")
+	sentinel.BeginShutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Error draining HTTP server: %v", err)
+	}
+	if err := sentinel.StopIngestion(ctx); err != nil {
+		log.Printf("Error flushing ingestion queues: %v", err)
 	}
+	sentinel.FlushFirewallHits()
+	log.Println("Shutdown complete")
 }
-
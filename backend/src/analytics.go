@@ -4,44 +4,58 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"log"
 	"math"
 	"net"
 	"net/http"
-	"strconv"
+	"net/netip"
+	"net/url"
 	"strings"
 	"time"
 
 	"github.com/oschwald/geoip2-golang"
+	"github.com/shopspring/decimal"
 	"github.com/ua-parser/uap-go/uaparser"
 )
 
 // --- EVENT TRACKING ---
 
 type Event struct {
-	SiteID      string   `json:"siteId"`
-	URL         string   `json:"url"`
-	Referrer    string   `json:"referrer"`
-	ScreenWidth int      `json:"screenWidth"`
-	LCP         *float64 `json:"LCP,omitempty"`
-	CLS         *float64 `json:"CLS,omitempty"`
-	FID         *float64 `json:"FID,omitempty"`
+	SiteID      string            `json:"siteId"`
+	Name        string            `json:"name,omitempty"` // custom event name, "pageview" when empty
+	Props       map[string]string `json:"props,omitempty"`
+	URL         string            `json:"url"`
+	Referrer    string            `json:"referrer"`
+	ScreenWidth int               `json:"screenWidth"`
+	LCP         *float64          `json:"LCP,omitempty"`
+	CLS         *float64          `json:"CLS,omitempty"`
+	FID         *float64          `json:"FID,omitempty"`
+	Revenue     *Revenue          `json:"revenue,omitempty"` // only on custom events
 }
 
 type EventData struct {
-	Timestamp   time.Time
-	SiteID      string
-	ClientIP    string
-	URL         string
-	Referrer    string
-	ScreenWidth uint16
-	Browser     string
-	OS          string
-	Country     string
-	TrustScore  uint8
-	LCP         sql.NullFloat64
-	CLS         sql.NullFloat64
-	FID         sql.NullFloat64
+	Timestamp       time.Time
+	SiteID          string
+	ClientIP        string // empty unless the site opted in to storing IPs
+	VisitorID       uint64
+	URL             string
+	Referrer        string
+	ScreenWidth     uint16
+	Browser         string
+	OS              string
+	Country         string
+	TrustScore      uint8
+	LCP             sql.NullFloat64
+	CLS             sql.NullFloat64
+	FID             sql.NullFloat64
+	EventName       string
+	Props           map[string]string
+	RevenueAmount   *decimal.Decimal
+	RevenueCurrency string
+	Attribution
+	Filtered       bool   // tagged by a firewall rule; excluded from stats
+	FirewallRuleID string // the tag rule that matched
 }
 
 // --- ANALYTICS ENGINE ---
@@ -54,52 +68,75 @@ func InitAnalyticsEngine() {
 	var err error
 	uaParser = uaparser.NewFromSaved()
 
-	geoipDb, err = geoip2.Open("GeoLite2-Country.mmdb")
+	geoipDb, err = geoip2.Open(config.GeoIP.CountryDB)
 	if err != nil {
-		log.Printf("Warning: GeoIP database 'GeoLite2-Country.mmdb' not found. Country lookups will be disabled. Error: %v", err)
+		log.Printf("Warning: GeoIP database '%s' not found. Country lookups will be disabled. Error: %v", config.GeoIP.CountryDB, err)
 	}
 
-	asnDb, err = geoip2.Open("GeoLite2-ASN.mmdb")
+	asnDb, err = geoip2.Open(config.GeoIP.ASNDB)
 	if err != nil {
-		log.Printf("Warning: ASN database 'GeoLite2-ASN.mmdb' not found. Bot detection will be less accurate. Error: %v", err)
+		log.Printf("Warning: ASN database '%s' not found. Bot detection will be less accurate. Error: %v", config.GeoIP.ASNDB, err)
 	}
 }
 
 type Stats struct {
-	TotalViews          uint64      `json:"totalViews"`
-	UniqueVisitors      uint64      `json:"uniqueVisitors"`
-	BounceRate          float64     `json:"bounceRate"`
-	AvgVisitTime        string      `json:"avgVisitTime"`
-	TrafficQualityScore float64     `json:"trafficQualityScore"`
-	AvgLCP              float64     `json:"avgLcp"`
-	AvgCLS              float64     `json:"avgCls"`
-	AvgFID              float64     `json:"avgFid"`
-	TopPages            []CountStat `json:"topPages"`
-	TopReferrers        []CountStat `json:"topReferrers"`
-	TopBrowsers         []CountStat `json:"topBrowsers"`
-	TopOS               []CountStat `json:"topOS"`
-	TopCountries        []CountStat `json:"topCountries"`
+	TotalViews          uint64          `json:"totalViews"`
+	UniqueVisitors      uint64          `json:"uniqueVisitors"`
+	Visits              uint64          `json:"visits"`
+	PagesPerVisit       float64         `json:"pagesPerVisit"`
+	BounceRate          float64         `json:"bounceRate"`
+	AvgVisitTime        string          `json:"avgVisitTime"`
+	TrafficQualityScore float64         `json:"trafficQualityScore"`
+	AvgLCP              float64         `json:"avgLcp"`
+	AvgCLS              float64         `json:"avgCls"`
+	AvgFID              float64         `json:"avgFid"`
+	Currency            string          `json:"currency"` // reporting currency of the revenue fields
+	TotalRevenue        float64         `json:"totalRevenue"`
+	AverageOrderValue   float64         `json:"averageOrderValue"`
+	RevenuePerVisitor   float64         `json:"revenuePerVisitor"`
+	UnconvertedOrders   uint64          `json:"unconvertedOrders"` // revenue events without an exchange rate, left out of the totals
+	TopPages            []CountStat     `json:"topPages"`
+	TopReferrers        []CountStat     `json:"topReferrers"`
+	TopBrowsers         []CountStat     `json:"topBrowsers"`
+	TopOS               []CountStat     `json:"topOS"`
+	TopCountries        []CountStat     `json:"topCountries"`
+	TopSources          []CountStat     `json:"topSources"`
+	TopMediums          []CountStat     `json:"topMediums"`
+	TopCampaigns        []CountStat     `json:"topCampaigns"`
+	EntryPages          []CountStat     `json:"entryPages"`
+	ExitPages           []CountStat     `json:"exitPages"`
+	Goals               []GoalStats     `json:"goals"`
+	RevenueBySource     []SourceRevenue `json:"revenueBySource"`
 
 	// Percentage changes
 	TotalViewsChange          float64 `json:"totalViewsChange"`
 	UniqueVisitorsChange      float64 `json:"uniqueVisitorsChange"`
+	VisitsChange              float64 `json:"visitsChange"`
+	PagesPerVisitChange       float64 `json:"pagesPerVisitChange"`
 	BounceRateChange          float64 `json:"bounceRateChange"`
 	AvgVisitTimeChange        float64 `json:"avgVisitTimeChange"`
 	TrafficQualityScoreChange float64 `json:"trafficQualityScoreChange"`
 	AvgLCPChange              float64 `json:"avgLcpChange"`
 	AvgCLSChange              float64 `json:"avgClsChange"`
 	AvgFIDChange              float64 `json:"avgFidChange"`
+	TotalRevenueChange        float64 `json:"totalRevenueChange"`
+	AverageOrderValueChange   float64 `json:"averageOrderValueChange"`
+	RevenuePerVisitorChange   float64 `json:"revenuePerVisitorChange"`
 }
 
 type CoreStats struct {
 	TotalViews          uint64
 	UniqueVisitors      uint64
+	Visits              uint64
+	PagesPerVisit       float64
 	BounceRate          float64
 	AvgVisitTime        float64 // in seconds
 	TrafficQualityScore float64
 	AvgLCP              float64
 	AvgCLS              float64
 	AvgFID              float64
+	Revenue             RevenueStats
+	RevenuePerVisitor   float64
 }
 
 type CountStat struct {
@@ -107,15 +144,45 @@ type CountStat struct {
 	Count uint64 `json:"count"`
 }
 
-func getClientIP(r *http.Request) string {
-	forwardedFor := r.Header.Get("X-Forwarded-For")
-	if forwardedFor != "" {
-		ips := strings.Split(forwardedFor, ",")
-		return strings.TrimSpace(ips[0])
+// trustedProxies are the parsed Config.TrustedProxies, set by LoadConfig.
+var trustedProxies []netip.Prefix
+
+func isTrustedProxy(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range trustedProxies {
+		if p.Contains(addr) {
+			return true
+		}
 	}
+	return false
+}
+
+// getClientIP returns the address of the client. X-Forwarded-For is only
+// believed when the peer is a trusted proxy, and is then read from the right,
+// skipping trusted hops: entries further left are whatever the client chose
+// to send.
+func getClientIP(r *http.Request) string {
 	ip, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		return r.RemoteAddr
+		ip = r.RemoteAddr
+	}
+	peer, err := netip.ParseAddr(ip)
+	if err != nil || !isTrustedProxy(peer) {
+		return ip
+	}
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		ip = addr.Unmap().String()
+		if !isTrustedProxy(addr) {
+			break
+		}
 	}
 	return ip
 }
@@ -154,6 +221,39 @@ func TrackHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Bad request", http.StatusBadRequest)
 		return
 	}
+	if err := normalizeCustomEvent(&event); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := normalizeRevenue(&event); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Revenue in a currency without an exchange rate could never be
+	// reported, so it is rejected rather than silently left out of stats.
+	if event.Revenue != nil {
+		known, err := hasExchangeRate(event.Revenue.Currency)
+		if err != nil {
+			log.Printf("Error looking up exchange rate: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if !known {
+			http.Error(w, "No exchange rate is configured for revenue currency "+event.Revenue.Currency, http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Hits for sites that don't exist are turned away before they reach the
+	// firewall, so made-up site IDs can't fill its cache.
+	settings, err := getSiteSettings(event.SiteID)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Unknown site", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading site settings: %v", err)
+	}
 
 	userAgent := r.UserAgent()
 	client := uaParser.Parse(userAgent)
@@ -178,22 +278,69 @@ func TrackHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	trustScore := calculateTrustScore(ip, userAgent)
-	var asn string
+	var asn uint
+	var asnOrg string
 	if asnDb != nil && ip != nil {
 		record, err := asnDb.ASN(ip)
 		if err == nil {
-			asn = record.AutonomousSystemOrganization
+			asn = record.AutonomousSystemNumber
+			asnOrg = record.AutonomousSystemOrganization
+		}
+	}
+	fwReq := firewallRequest{IP: ip, Country: country, ASN: asn, ASNOrg: asnOrg, UserAgent: userAgent, TrustScore: trustScore}
+	if u, err := url.Parse(event.URL); err == nil {
+		fwReq.Hostname = u.Hostname()
+		fwReq.Path = u.Path
+		if fwReq.Path == "" {
+			fwReq.Path = "/"
 		}
 	}
-	if isBlocked(event.SiteID, ipStr, country, asn) {
+	if u, err := url.Parse(event.Referrer); err == nil {
+		fwReq.ReferrerHost = u.Hostname()
+	}
+	// Raw IPs are only kept, in events and in the firewall log, for sites
+	// that opted in.
+	storedIP := ""
+	if settings.StoreIP {
+		storedIP = ipStr
+	}
+
+	verdict := evaluateFirewall(event.SiteID, fwReq)
+	for _, rule := range verdict.DryRun {
+		log.Printf("Firewall dry run: rule %s (%s %s) matched a hit on site %s", rule.ID, rule.RuleType, rule.Value, event.SiteID)
+		logFirewallEvent(event.SiteID, storedIP, event.URL, fwReq, rule.ID, rule.RuleType, ActionLogOnly)
+	}
+	ruleHits.record(time.Now(), verdict.matched()...)
+	if verdict.Action == ActionBlock {
+		logFirewallEvent(event.SiteID, storedIP, event.URL, fwReq, verdict.Rule.ID, verdict.Rule.RuleType, ActionBlock)
 		http.Error(w, "Forbidden by firewall", http.StatusForbidden)
 		return
 	}
+	if verdict.Action == ActionChallenge {
+		logFirewallEvent(event.SiteID, storedIP, event.URL, fwReq, verdict.Rule.ID, verdict.Rule.RuleType, ActionChallenge)
+	}
+	// Allow rules exempt trusted sources, such as uptime monitors, from the rate limit.
+	if verdict.Action != ActionAllow && !trackLimiter.allow(event.SiteID, ipStr) {
+		var banID string
+		if ban := trackLimiter.activeBan(event.SiteID, ipStr); ban != nil {
+			banID = ban.ID
+		}
+		logFirewallEvent(event.SiteID, storedIP, event.URL, fwReq, banID, "", ActionRateLimit)
+		http.Error(w, "Too many requests", http.StatusTooManyRequests)
+		return
+	}
 
+	visitor, err := visitorID(event.SiteID, ipStr, userAgent)
+	if err != nil {
+		log.Printf("Error computing visitor ID: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
 	eventData := EventData{
 		Timestamp:   time.Now().UTC(),
 		SiteID:      event.SiteID,
-		ClientIP:    ipStr,
+		ClientIP:    storedIP,
+		VisitorID:   visitor,
 		URL:         event.URL,
 		Referrer:    event.Referrer,
 		ScreenWidth: uint16(event.ScreenWidth),
@@ -204,17 +351,22 @@ func TrackHandler(w http.ResponseWriter, r *http.Request) {
 		LCP:         nullFloat64(event.LCP),
 		CLS:         nullFloat64(event.CLS),
 		FID:         nullFloat64(event.FID),
+		EventName:   event.Name,
+		Props:       event.Props,
+		Attribution: attributeTraffic(event.URL, event.Referrer),
+	}
+	if verdict.Action == ActionTag || verdict.Action == ActionChallenge {
+		eventData.Filtered = true
+		eventData.FirewallRuleID = verdict.Rule.ID
+	}
+	if event.Revenue != nil {
+		eventData.RevenueAmount = &event.Revenue.Amount
+		eventData.RevenueCurrency = event.Revenue.Currency
 	}
 
-	ctx := context.Background()
-	err := chConn.AsyncInsert(ctx, "INSERT INTO sentinel.events VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", false,
-		eventData.Timestamp, eventData.SiteID, eventData.ClientIP, eventData.URL, eventData.Referrer,
-		eventData.ScreenWidth, eventData.Browser, eventData.OS, eventData.Country, eventData.TrustScore,
-		eventData.LCP, eventData.CLS, eventData.FID,
-	)
-	if err != nil {
-		log.Printf("Error inserting event into ClickHouse: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	if !eventIngester.Enqueue(eventData) {
+		log.Printf("Ingestion queue full, dropping event for site %s", eventData.SiteID)
+		http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
 		return
 	}
 
@@ -223,56 +375,28 @@ func TrackHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 }
 
-func isBlocked(siteID, ip, country, asn string) bool {
-	rows, err := db.Query("SELECT rule_type, value FROM firewall_rules WHERE site_id = $1", siteID)
-	if err != nil {
-		log.Printf("Error querying firewall rules: %v", err)
-		return false
-	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var ruleType, value string
-		if err := rows.Scan(&ruleType, &value); err != nil {
-			log.Printf("Error scanning firewall rule: %v", err)
-			continue
-		}
-		switch ruleType {
-		case "ip":
-			if strings.Contains(value, "/") {
-				_, ipNet, err := net.ParseCIDR(value)
-				if err == nil && ipNet.Contains(net.ParseIP(ip)) {
-					return true
-				}
-			} else if value == ip {
-				return true
-			}
-		case "country":
-			if value == country {
-				return true
-			}
-		case "asn":
-			if value == asn {
-				return true
-			}
-		}
-	}
-	return false
-}
-
 func DashboardApiHandler(w http.ResponseWriter, r *http.Request) {
 	siteID := r.URL.Query().Get("siteId")
 	if siteID == "" {
 		http.Error(w, "siteId query parameter is required", http.StatusBadRequest)
 		return
 	}
-	daysStr := r.URL.Query().Get("days")
-	days, err := strconv.Atoi(daysStr)
-	if err != nil || days <= 0 {
-		days = 30 // Default to 30 days
+	if !canAccessSite(r, siteID, ScopeStatsRead) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	dr, err := siteDateRange(r, siteID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filters, err := parseFilters(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	stats, err := calculateStats(siteID, days)
+	stats, err := calculateStats(StatsQuery{SiteID: siteID, Range: dr, Filters: filters})
 	if err != nil {
 		log.Printf("Error calculating stats: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
@@ -280,7 +404,7 @@ func DashboardApiHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Log the stats object before sending
-	log.Printf("Dashboard stats for site %s (last %d days): %+v", siteID, days, stats)
+	log.Printf("Dashboard stats for site %s (%s to %s): %+v", siteID, dr.From.Format(time.RFC3339), dr.To.Format(time.RFC3339), stats)
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(stats); err != nil {
@@ -300,61 +424,47 @@ func calculateChange(current, previous float64) float64 {
 	return ((current - previous) / previous) * 100
 }
 
-func getCoreStats(ctx context.Context, siteID string, startDaysAgo, endDaysAgo int) (CoreStats, error) {
+func getCoreStats(ctx context.Context, q StatsQuery, currency string, rates map[string]decimal.Decimal) (CoreStats, error) {
 	var stats CoreStats
+	where, args := q.where()
 
 	// Total Views - only count events that are not web-vital reports
-	queryTotalViews := "SELECT count() FROM events WHERE SiteID = ? AND LCP IS NULL AND CLS IS NULL AND FID IS NULL AND Timestamp BETWEEN now() - INTERVAL ? DAY AND now() - INTERVAL ? DAY"
-	err := chConn.QueryRow(ctx, queryTotalViews, siteID, startDaysAgo, endDaysAgo).Scan(&stats.TotalViews)
+	queryTotalViews := "SELECT count() FROM events WHERE " + where + " AND EventName = 'pageview' AND LCP IS NULL AND CLS IS NULL AND FID IS NULL"
+	err := chConn.QueryRow(ctx, queryTotalViews, args...).Scan(&stats.TotalViews)
 	if err != nil && err != sql.ErrNoRows {
 		return stats, err
 	}
 
 	// Unique Visitors
-	queryUniqueVisitors := "SELECT uniq(ClientIP) FROM events WHERE SiteID = ? AND Timestamp BETWEEN now() - INTERVAL ? DAY AND now() - INTERVAL ? DAY"
-	err = chConn.QueryRow(ctx, queryUniqueVisitors, siteID, startDaysAgo, endDaysAgo).Scan(&stats.UniqueVisitors)
+	queryUniqueVisitors := "SELECT uniq(VisitorID) FROM events WHERE " + where
+	err = chConn.QueryRow(ctx, queryUniqueVisitors, args...).Scan(&stats.UniqueVisitors)
 	if err != nil && err != sql.ErrNoRows {
 		return stats, err
 	}
 
-	// Bounce Rate
-	queryBounceRate := `
-		SELECT (countIf(pageviews = 1) / count()) * 100
-		FROM (
-			SELECT ClientIP, count() AS pageviews
-			FROM events
-			WHERE SiteID = ? AND Timestamp BETWEEN now() - INTERVAL ? DAY AND now() - INTERVAL ? DAY
-			GROUP BY ClientIP
-		)`
-	err = chConn.QueryRow(ctx, queryBounceRate, siteID, startDaysAgo, endDaysAgo).Scan(&stats.BounceRate)
+	// Visits, Pages per Visit, Bounce Rate and Average Visit Duration
+	queryVisits := `
+		SELECT count(), avg(pageviews), (countIf(pageviews = 1) / count()) * 100, avg(duration)
+		FROM (` + visitsSubquery(where) + `)`
+	err = chConn.QueryRow(ctx, queryVisits, append([]any{visitTimeoutSeconds()}, args...)...).
+		Scan(&stats.Visits, &stats.PagesPerVisit, &stats.BounceRate, &stats.AvgVisitTime)
 	if err != nil {
-		stats.BounceRate = 0
+		stats.Visits, stats.PagesPerVisit, stats.BounceRate, stats.AvgVisitTime = 0, 0, 0, 0
+	}
+	if math.IsNaN(stats.PagesPerVisit) {
+		stats.PagesPerVisit = 0
 	}
 	if math.IsNaN(stats.BounceRate) {
 		stats.BounceRate = 0
 	}
-
-	// Average Visit Duration
-	queryAvgVisitTime := `
-		SELECT avg(duration)
-		FROM (
-			SELECT ClientIP, date_diff('second', min(Timestamp), max(Timestamp)) AS duration
-			FROM events
-			WHERE SiteID = ? AND Timestamp BETWEEN now() - INTERVAL ? DAY AND now() - INTERVAL ? DAY
-			GROUP BY ClientIP
-		)`
-	err = chConn.QueryRow(ctx, queryAvgVisitTime, siteID, startDaysAgo, endDaysAgo).Scan(&stats.AvgVisitTime)
-	if err != nil {
-		stats.AvgVisitTime = 0
-	}
 	if math.IsNaN(stats.AvgVisitTime) {
 		stats.AvgVisitTime = 0
 	}
 
 	// Traffic Quality Score
-	queryGoodTraffic := "SELECT count() FROM events WHERE SiteID = ? AND Timestamp BETWEEN now() - INTERVAL ? DAY AND now() - INTERVAL ? DAY AND TrustScore > 50"
+	queryGoodTraffic := "SELECT count() FROM events WHERE " + where + " AND TrustScore > 50"
 	var goodTrafficCount uint64
-	err = chConn.QueryRow(ctx, queryGoodTraffic, siteID, startDaysAgo, endDaysAgo).Scan(&goodTrafficCount)
+	err = chConn.QueryRow(ctx, queryGoodTraffic, args...).Scan(&goodTrafficCount)
 	if err != nil || stats.TotalViews == 0 {
 		stats.TrafficQualityScore = 0
 	} else {
@@ -362,34 +472,49 @@ func getCoreStats(ctx context.Context, siteID string, startDaysAgo, endDaysAgo i
 	}
 
 	// Web Vitals
-	chConn.QueryRow(ctx, "SELECT avg(LCP) FROM events WHERE SiteID = ? AND Timestamp BETWEEN now() - INTERVAL ? DAY AND now() - INTERVAL ? DAY", siteID, startDaysAgo, endDaysAgo).Scan(&stats.AvgLCP)
+	chConn.QueryRow(ctx, "SELECT avg(LCP) FROM events WHERE "+where, args...).Scan(&stats.AvgLCP)
 	if math.IsNaN(stats.AvgLCP) {
 		stats.AvgLCP = 0
 	}
-	chConn.QueryRow(ctx, "SELECT avg(CLS) FROM events WHERE SiteID = ? AND Timestamp BETWEEN now() - INTERVAL ? DAY AND now() - INTERVAL ? DAY", siteID, startDaysAgo, endDaysAgo).Scan(&stats.AvgCLS)
+	chConn.QueryRow(ctx, "SELECT avg(CLS) FROM events WHERE "+where, args...).Scan(&stats.AvgCLS)
 	if math.IsNaN(stats.AvgCLS) {
 		stats.AvgCLS = 0
 	}
-	chConn.QueryRow(ctx, "SELECT avg(FID) FROM events WHERE SiteID = ? AND Timestamp BETWEEN now() - INTERVAL ? DAY AND now() - INTERVAL ? DAY", siteID, startDaysAgo, endDaysAgo).Scan(&stats.AvgFID)
+	chConn.QueryRow(ctx, "SELECT avg(FID) FROM events WHERE "+where, args...).Scan(&stats.AvgFID)
 	if math.IsNaN(stats.AvgFID) {
 		stats.AvgFID = 0
 	}
 
+	// Revenue, converted into the site's reporting currency
+	stats.Revenue, err = queryRevenue(ctx, q, currency, rates)
+	if err != nil {
+		return stats, err
+	}
+	if stats.UniqueVisitors > 0 {
+		stats.RevenuePerVisitor = stats.Revenue.Total.Div(decimal.NewFromInt(int64(stats.UniqueVisitors))).InexactFloat64()
+	}
+
 	return stats, nil
 }
 
-func calculateStats(siteID string, days int) (Stats, error) {
+func calculateStats(q StatsQuery) (Stats, error) {
 	ctx := context.Background()
 	var finalStats Stats
 
+	currency := siteCurrency(q.SiteID)
+	rates, err := loadExchangeRates()
+	if err != nil {
+		return finalStats, err
+	}
+
 	// Get stats for the current period (e.g., last 30 days)
-	currentStats, err := getCoreStats(ctx, siteID, days, 0)
+	currentStats, err := getCoreStats(ctx, q, currency, rates)
 	if err != nil {
 		return finalStats, err
 	}
 
-	// Get stats for the previous period (e.g., 31-60 days ago)
-	previousStats, err := getCoreStats(ctx, siteID, days*2, days)
+	// Get stats for the previous period of equal length (e.g., 31-60 days ago)
+	previousStats, err := getCoreStats(ctx, q.previous(), currency, rates)
 	if err != nil {
 		return finalStats, err
 	}
@@ -397,6 +522,8 @@ func calculateStats(siteID string, days int) (Stats, error) {
 	// Populate the final stats struct
 	finalStats.TotalViews = currentStats.TotalViews
 	finalStats.UniqueVisitors = currentStats.UniqueVisitors
+	finalStats.Visits = currentStats.Visits
+	finalStats.PagesPerVisit = currentStats.PagesPerVisit
 	finalStats.BounceRate = currentStats.BounceRate
 	d := time.Duration(currentStats.AvgVisitTime) * time.Second
 	finalStats.AvgVisitTime = d.Round(time.Second).String()
@@ -404,30 +531,67 @@ func calculateStats(siteID string, days int) (Stats, error) {
 	finalStats.AvgLCP = currentStats.AvgLCP
 	finalStats.AvgCLS = currentStats.AvgCLS
 	finalStats.AvgFID = currentStats.AvgFID
+	finalStats.Currency = currency
+	finalStats.TotalRevenue = currentStats.Revenue.Total.Round(2).InexactFloat64()
+	finalStats.AverageOrderValue = currentStats.Revenue.AverageOrderValue.Round(2).InexactFloat64()
+	finalStats.RevenuePerVisitor = math.Round(currentStats.RevenuePerVisitor*100) / 100
+	finalStats.UnconvertedOrders = currentStats.Revenue.UnconvertedOrders
 
 	// Calculate percentage changes
 	finalStats.TotalViewsChange = calculateChange(float64(currentStats.TotalViews), float64(previousStats.TotalViews))
 	finalStats.UniqueVisitorsChange = calculateChange(float64(currentStats.UniqueVisitors), float64(previousStats.UniqueVisitors))
+	finalStats.VisitsChange = calculateChange(float64(currentStats.Visits), float64(previousStats.Visits))
+	finalStats.PagesPerVisitChange = calculateChange(currentStats.PagesPerVisit, previousStats.PagesPerVisit)
 	finalStats.BounceRateChange = calculateChange(currentStats.BounceRate, previousStats.BounceRate)
 	finalStats.AvgVisitTimeChange = calculateChange(currentStats.AvgVisitTime, previousStats.AvgVisitTime)
 	finalStats.TrafficQualityScoreChange = calculateChange(currentStats.TrafficQualityScore, previousStats.TrafficQualityScore)
 	finalStats.AvgLCPChange = calculateChange(currentStats.AvgLCP, previousStats.AvgLCP)
 	finalStats.AvgCLSChange = calculateChange(currentStats.AvgCLS, previousStats.AvgCLS)
 	finalStats.AvgFIDChange = calculateChange(currentStats.AvgFID, previousStats.AvgFID)
+	finalStats.TotalRevenueChange = calculateChange(currentStats.Revenue.Total.InexactFloat64(), previousStats.Revenue.Total.InexactFloat64())
+	finalStats.AverageOrderValueChange = calculateChange(currentStats.Revenue.AverageOrderValue.InexactFloat64(), previousStats.Revenue.AverageOrderValue.InexactFloat64())
+	finalStats.RevenuePerVisitorChange = calculateChange(currentStats.RevenuePerVisitor, previousStats.RevenuePerVisitor)
 
 	// Top stats are still for the current period
-	finalStats.TopPages, _ = queryTopStats(ctx, "URL", siteID, days)
-	finalStats.TopReferrers, _ = queryTopStats(ctx, "Referrer", siteID, days)
-	finalStats.TopBrowsers, _ = queryTopStats(ctx, "Browser", siteID, days)
-	finalStats.TopOS, _ = queryTopStats(ctx, "OS", siteID, days)
-	finalStats.TopCountries, _ = queryTopStats(ctx, "Country", siteID, days)
+	finalStats.TopPages, _ = queryTopStats(ctx, "URL", q)
+	finalStats.TopReferrers, _ = queryTopStats(ctx, "Referrer", q)
+	finalStats.TopBrowsers, _ = queryTopStats(ctx, "Browser", q)
+	finalStats.TopOS, _ = queryTopStats(ctx, "OS", q)
+	finalStats.TopCountries, _ = queryTopStats(ctx, "Country", q)
+	finalStats.TopSources, _ = queryTopStats(ctx, "Source", q)
+	finalStats.TopMediums, _ = queryTopStatsWhere(ctx, "Medium", q, "Medium != ''")
+	finalStats.TopCampaigns, _ = queryTopStatsWhere(ctx, "UTMCampaign", q, "UTMCampaign != ''")
+	finalStats.EntryPages, _ = queryTopVisitPages(ctx, "entry_page", q)
+	finalStats.ExitPages, _ = queryTopVisitPages(ctx, "exit_page", q)
+
+	finalStats.RevenueBySource, err = queryRevenueBySource(ctx, q, currency, rates)
+	if err != nil {
+		log.Printf("Error calculating revenue by source: %v", err)
+		finalStats.RevenueBySource = []SourceRevenue{}
+	}
+
+	finalStats.Goals, err = calculateGoalStats(ctx, q)
+	if err != nil {
+		log.Printf("Error calculating goal stats: %v", err)
+		finalStats.Goals = []GoalStats{}
+	}
 
 	return finalStats, nil
 }
 
-func queryTopStats(ctx context.Context, column, siteID string, days int) ([]CountStat, error) {
-	query := "SELECT " + column + ", count() AS c FROM events WHERE SiteID = ? AND Timestamp >= now() - INTERVAL ? DAY GROUP BY " + column + " ORDER BY c DESC LIMIT 10"
-	rows, err := chConn.Query(ctx, query, siteID, days)
+func queryTopStats(ctx context.Context, column string, q StatsQuery) ([]CountStat, error) {
+	return queryTopStatsWhere(ctx, column, q, "")
+}
+
+// queryTopStatsWhere is queryTopStats with an extra, constant condition such
+// as excluding empty values.
+func queryTopStatsWhere(ctx context.Context, column string, q StatsQuery, extra string) ([]CountStat, error) {
+	where, args := q.where()
+	if extra != "" {
+		where += " AND " + extra
+	}
+	query := "SELECT " + column + ", count() AS c FROM events WHERE " + where + " GROUP BY " + column + " ORDER BY c DESC LIMIT 10"
+	rows, err := chConn.Query(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -450,4 +614,3 @@ func nullFloat64(f *float64) sql.NullFloat64 {
 	}
 	return sql.NullFloat64{Float64: *f, Valid: true}
 }
-
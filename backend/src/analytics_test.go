@@ -0,0 +1,38 @@
+package sentinel
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestGetClientIP(t *testing.T) {
+	defer func(saved []string) { trustedProxies, _ = parsePrefixes(saved) }(config.TrustedProxies)
+	trustedProxies, _ = parsePrefixes([]string{"10.0.0.0/8", "::1"})
+
+	tests := []struct {
+		name   string
+		remote string
+		xff    []string
+		want   string
+	}{
+		{"direct", "203.0.113.7:5000", nil, "203.0.113.7"},
+		{"spoofed header from untrusted peer", "203.0.113.7:5000", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"one proxy", "10.0.0.2:5000", []string{"203.0.113.7"}, "203.0.113.7"},
+		{"client-supplied entries ignored", "10.0.0.2:5000", []string{"198.51.100.1, 203.0.113.7"}, "203.0.113.7"},
+		{"proxy chain", "10.0.0.2:5000", []string{"198.51.100.1, 203.0.113.7, 10.0.0.9"}, "203.0.113.7"},
+		{"multiple headers", "10.0.0.2:5000", []string{"198.51.100.1", "203.0.113.7"}, "203.0.113.7"},
+		{"garbage hop", "10.0.0.2:5000", []string{"203.0.113.7, not-an-ip"}, "10.0.0.2"},
+		{"trusted peer without header", "10.0.0.2:5000", nil, "10.0.0.2"},
+		{"ipv6 proxy", "[::1]:5000", []string{"2001:db8::7"}, "2001:db8::7"},
+	}
+	for _, tt := range tests {
+		r, _ := http.NewRequest("POST", "/track", nil)
+		r.RemoteAddr = tt.remote
+		for _, v := range tt.xff {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		if got := getClientIP(r); got != tt.want {
+			t.Errorf("%s: getClientIP = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package sentinel
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// API key scopes
+const (
+	ScopeStatsRead      = "stats:read"
+	ScopeFirewallManage = "firewall:manage"
+	ScopeFunnelsManage  = "funnels:manage"
+)
+
+var validScopes = map[string]bool{
+	ScopeStatsRead:      true,
+	ScopeFirewallManage: true,
+	ScopeFunnelsManage:  true,
+}
+
+const apiKeyPrefix = "sk_"
+
+// APIKey grants programmatic access to one or more sites.
+type APIKey struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	SiteIDs    []string   `json:"siteIds"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+	Key        string     `json:"key,omitempty"` // only returned once, on creation
+	userID     int
+}
+
+func (k *APIKey) hasSite(siteID string) bool {
+	for _, id := range k.SiteIDs {
+		if id == siteID {
+			return true
+		}
+	}
+	return false
+}
+
+func (k *APIKey) hasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// APIAuthMiddleware authenticates a request with either an API key sent as
+// "Authorization: Bearer sk_..." or the browser session cookie. Handlers behind
+// it must authorize site access with canAccessSite.
+func APIAuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") {
+			AuthMiddleware(next)(w, r)
+			return
+		}
+		key, err := lookupAPIKey(strings.TrimSpace(strings.TrimPrefix(auth, "Bearer ")))
+		if err != nil {
+			http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
+			return
+		}
+		ctx := context.WithValue(r.Context(), "userID", key.userID)
+		ctx = context.WithValue(ctx, "apiKey", key)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}
+}
+
+func lookupAPIKey(raw string) (*APIKey, error) {
+	if !strings.HasPrefix(raw, apiKeyPrefix) {
+		return nil, errInvalidSession
+	}
+	var key APIKey
+	err := db.QueryRow("SELECT id, user_id, name, key_prefix, site_ids, scopes FROM api_keys WHERE key_hash = $1", hashToken(raw)).
+		Scan(&key.ID, &key.userID, &key.Name, &key.Prefix, pq.Array(&key.SiteIDs), pq.Array(&key.Scopes))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec("UPDATE api_keys SET last_used_at = now() WHERE id = $1", key.ID); err != nil {
+		log.Printf("Error updating API key usage: %v", err)
+	}
+	return &key, nil
+}
+
+// canAccessSite reports whether the authenticated caller may act on siteID.
+// Session users must own the site; API keys must additionally be issued for
+// the site and carry the required scope.
+func canAccessSite(r *http.Request, siteID, scope string) bool {
+	userID := r.Context().Value("userID").(int)
+	var ownerID int
+	err := db.QueryRow("SELECT user_id FROM sites WHERE id = $1", siteID).Scan(&ownerID)
+	if err != nil || ownerID != userID {
+		return false
+	}
+	if key, ok := r.Context().Value("apiKey").(*APIKey); ok {
+		return key.hasSite(siteID) && key.hasScope(scope)
+	}
+	return true
+}
+
+// handleSiteKeys serves /api/sites/{id}/keys and /api/sites/{id}/keys/{keyId}.
+func handleSiteKeys(w http.ResponseWriter, r *http.Request, siteID, keyID string) {
+	if keyID == "" {
+		switch r.Method {
+		case "GET":
+			handleListAPIKeys(w, r, siteID)
+		case "POST":
+			handleCreateAPIKey(w, r, siteID)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+	if r.Method != "DELETE" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	handleRevokeAPIKey(w, r, siteID, keyID)
+}
+
+// @Summary List API keys
+// @Description List the API keys that grant access to a site.
+// @Tags keys
+// @Produce  json
+// @Param id path string true "Site ID"
+// @Success 200 {array} APIKey
+// @Router /api/sites/{id}/keys [get]
+func handleListAPIKeys(w http.ResponseWriter, r *http.Request, siteID string) {
+	userID := r.Context().Value("userID").(int)
+	if !canAccessSite(r, siteID, "") {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	rows, err := db.Query("SELECT id, name, key_prefix, site_ids, scopes, created_at, last_used_at FROM api_keys WHERE user_id = $1 AND $2 = ANY(site_ids) ORDER BY created_at DESC", userID, siteID)
+	if err != nil {
+		http.Error(w, "Failed to fetch API keys", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		var key APIKey
+		if err := rows.Scan(&key.ID, &key.Name, &key.Prefix, pq.Array(&key.SiteIDs), pq.Array(&key.Scopes), &key.CreatedAt, &key.LastUsedAt); err != nil {
+			http.Error(w, "Failed to scan API key", http.StatusInternalServerError)
+			return
+		}
+		keys = append(keys, key)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
+
+// @Summary Create an API key
+// @Description Create an API key for a site. Additional sites owned by the same user may be listed in siteIds. The raw key is only returned in this response.
+// @Tags keys
+// @Accept  json
+// @Produce  json
+// @Param id path string true "Site ID"
+// @Param key body APIKey true "Key name, scopes and optional extra site IDs"
+// @Success 201 {object} APIKey
+// @Router /api/sites/{id}/keys [post]
+func handleCreateAPIKey(w http.ResponseWriter, r *http.Request, siteID string) {
+	userID := r.Context().Value("userID").(int)
+	var key APIKey
+	if err := json.NewDecoder(r.Body).Decode(&key); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if key.Name == "" {
+		http.Error(w, "Key name is required", http.StatusBadRequest)
+		return
+	}
+	if len(key.Scopes) == 0 {
+		http.Error(w, "At least one scope is required", http.StatusBadRequest)
+		return
+	}
+	for _, scope := range key.Scopes {
+		if !validScopes[scope] {
+			http.Error(w, "Invalid scope. Must be 'stats:read', 'firewall:manage', or 'funnels:manage'", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// The key always covers the site in the path, plus any extra sites requested.
+	siteIDs := []string{siteID}
+	for _, id := range key.SiteIDs {
+		if id != siteID {
+			siteIDs = append(siteIDs, id)
+		}
+	}
+	for _, id := range siteIDs {
+		if !canAccessSite(r, id, "") {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+	}
+
+	token, err := newOpaqueToken()
+	if err != nil {
+		http.Error(w, "Failed to generate API key", http.StatusInternalServerError)
+		return
+	}
+	raw := apiKeyPrefix + token
+	key.Prefix = raw[:len(apiKeyPrefix)+6]
+	key.SiteIDs = siteIDs
+
+	err = db.QueryRow("INSERT INTO api_keys (user_id, name, key_prefix, key_hash, site_ids, scopes) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id, created_at",
+		userID, key.Name, key.Prefix, hashToken(raw), pq.Array(key.SiteIDs), pq.Array(key.Scopes)).Scan(&key.ID, &key.CreatedAt)
+	if err != nil {
+		log.Printf("Error creating API key: %v", err)
+		http.Error(w, "Failed to create API key", http.StatusInternalServerError)
+		return
+	}
+
+	key.Key = raw
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(key)
+}
+
+// @Summary Revoke an API key
+// @Description Permanently revoke an API key.
+// @Tags keys
+// @Param id path string true "Site ID"
+// @Param keyId path string true "API key ID"
+// @Success 204 "No Content"
+// @Router /api/sites/{id}/keys/{keyId} [delete]
+func handleRevokeAPIKey(w http.ResponseWriter, r *http.Request, siteID, keyID string) {
+	userID := r.Context().Value("userID").(int)
+	if !canAccessSite(r, siteID, "") {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	res, err := db.Exec("DELETE FROM api_keys WHERE id = $1 AND user_id = $2 AND $3 = ANY(site_ids)", keyID, userID, siteID)
+	if err != nil {
+		http.Error(w, "Failed to revoke API key", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,100 @@
+package sentinel
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	sessionCookieName = "sentinel_session"
+	sessionTTL        = 24 * time.Hour
+)
+
+var errInvalidSession = errors.New("invalid or expired session")
+
+// newOpaqueToken returns a random, URL-safe opaque token. Only its hash is
+// ever written to the database.
+func newOpaqueToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// createSession stores a new session for userID and returns the raw token to
+// hand to the client.
+func createSession(userID int, r *http.Request) (string, time.Time, error) {
+	token, err := newOpaqueToken()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	expiresAt := time.Now().Add(sessionTTL)
+	_, err = db.Exec("INSERT INTO sessions (user_id, token_hash, user_agent, ip, expires_at) VALUES ($1, $2, $3, $4, $5)",
+		userID, hashToken(token), r.UserAgent(), getClientIP(r), expiresAt)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	// Opportunistically drop this user's expired sessions.
+	if _, err := db.Exec("DELETE FROM sessions WHERE user_id = $1 AND expires_at <= now()", userID); err != nil {
+		log.Printf("Error pruning expired sessions: %v", err)
+	}
+	return token, expiresAt, nil
+}
+
+// lookupSession resolves a raw token to its session and user IDs.
+func lookupSession(token string) (string, int, error) {
+	if token == "" {
+		return "", 0, errInvalidSession
+	}
+	var sessionID string
+	var userID int
+	err := db.QueryRow("SELECT id, user_id FROM sessions WHERE token_hash = $1 AND expires_at > now()", hashToken(token)).Scan(&sessionID, &userID)
+	if err != nil {
+		return "", 0, errInvalidSession
+	}
+	return sessionID, userID, nil
+}
+
+func revokeSession(token string) error {
+	_, err := db.Exec("DELETE FROM sessions WHERE token_hash = $1", hashToken(token))
+	return err
+}
+
+func setSessionCookie(w http.ResponseWriter, token string, expiresAt time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  expiresAt,
+		HttpOnly: true,
+		Secure:   true, // Important for cross-domain
+		SameSite: http.SameSiteNoneMode,
+		Domain:   config.CookieDomain, // Parent domain shared with the dashboard
+	})
+}
+
+func clearSessionCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		Expires:  time.Unix(0, 0),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteNoneMode,
+		Domain:   config.CookieDomain,
+	})
+}
@@ -2,8 +2,12 @@ package sentinel
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"log"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/ClickHouse/clickhouse-go/v2"
@@ -12,42 +16,178 @@ import (
 
 var chConn driver.Conn
 
+// InitClickHouse opens the ClickHouse connection pool. If the server cannot be
+// reached yet, it keeps retrying in the background instead of exiting; the
+// driver redials dropped connections on its own once it is up.
 func InitClickHouse() {
-	var err error
-	var conn driver.Conn
-
-	for i := 0; i < 5; i++ {
-		conn, err = clickhouse.Open(&clickhouse.Options{
-			Addr: []string{"clickhouse:9000"},
-			Auth: clickhouse.Auth{
-				Database: "sentinel",
-				Username: "sentinel",
-				Password: "password",
-			},
-			Settings: clickhouse.Settings{
-				"max_execution_time": 60,
-			},
-		})
+	if err := openClickHouse(); err != nil {
+		log.Fatalf("Invalid ClickHouse options: %v", err)
+	}
+	connect := func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := pingClickHouse(ctx); err != nil {
+			return err
+		}
+		return runStartupMigrations(storeClickHouse)
+	}
+	if err := retryConnect("ClickHouse", 5, connect); err != nil {
+		go retryConnectForever("ClickHouse", connect, clickhouseReady)
+		return
+	}
+	fmt.Println("Successfully connected to ClickHouse!")
+	clickhouseReady()
+}
+
+// clickhouseReady runs once ClickHouse is reachable and migrated.
+func clickhouseReady() {
+	chReady.Store(true)
+	applyRetention()
+}
+
+// openClickHouse opens the pool on the configured database. Queries,
+// inserts and migrations use unqualified table names, so they all resolve
+// to that database.
+func openClickHouse() error {
+	conn, err := dialClickHouse(config.ClickHouse.Database)
+	if err != nil {
+		return err
+	}
+	chConn = conn
+	return nil
+}
+
+func dialClickHouse(database string) (driver.Conn, error) {
+	cfg := config.ClickHouse
+	tlsConfig, err := cfg.tlsConfig()
+	if err != nil {
+		return nil, fmt.Errorf("TLS settings: %w", err)
+	}
+	return clickhouse.Open(&clickhouse.Options{
+		Addr: cfg.Addrs,
+		Auth: clickhouse.Auth{
+			Database: database,
+			Username: cfg.Username,
+			Password: cfg.Password,
+		},
+		TLS: tlsConfig,
+		Settings: clickhouse.Settings{
+			"max_execution_time": 60,
+		},
+	})
+}
+
+// pingClickHouse checks the pool can connect. If it cannot, the configured
+// database may not exist yet, so it tries to create it and pings again.
+func pingClickHouse(ctx context.Context) error {
+	err := chConn.Ping(ctx)
+	if err == nil {
+		return nil
+	}
+	if ensureClickHouseDatabase(ctx) != nil {
+		return err
+	}
+	return chConn.Ping(ctx)
+}
+
+// ensureClickHouseDatabase creates the configured database if it is
+// missing. The pool cannot do this itself, since ClickHouse refuses
+// connections to a database that does not exist.
+func ensureClickHouseDatabase(ctx context.Context) error {
+	conn, err := dialClickHouse("default")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	name := strings.ReplaceAll(config.ClickHouse.Database, "`", "``")
+	return conn.Exec(ctx, fmt.Sprintf("CREATE DATABASE IF NOT EXISTS `%s`", name))
+}
 
+// tlsConfig builds the TLS settings for the ClickHouse connection, or nil
+// when TLS is disabled.
+func (c ClickHouseConfig) tlsConfig() (*tls.Config, error) {
+	if !c.TLS {
+		return nil, nil
+	}
+	tc := &tls.Config{InsecureSkipVerify: c.TLSSkipVerify}
+	if c.TLSCAFile != "" {
+		pem, err := os.ReadFile(c.TLSCAFile)
 		if err != nil {
-			log.Printf("Error connecting to ClickHouse: %v. Retrying in 3 seconds...", err)
-			time.Sleep(3 * time.Second)
-			continue
+			return nil, err
 		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.TLSCAFile)
+		}
+		tc.RootCAs = pool
+	}
+	return tc, nil
+}
 
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-
-		if err = conn.Ping(ctx); err != nil {
-			log.Printf("Error pinging ClickHouse: %v. Retrying in 3 seconds...", err)
-			time.Sleep(3 * time.Second)
+// applyRetention sets table TTLs from Config.Retention. A zero retention
+// leaves the table's TTL as it is. Tables already on the configured TTL are
+// left alone, and a changed TTL is not materialized over existing parts,
+// so restarts don't kick off a mutation rewriting the whole table; old rows
+// are dropped as parts are merged.
+func applyRetention() {
+	tables := []struct {
+		name string
+		days int
+	}{
+		{"events", config.Retention.EventsDays},
+		{"session_events", config.Retention.SessionReplayDays},
+	}
+	ctx := context.Background()
+	for _, t := range tables {
+		if t.days <= 0 {
+			continue
+		}
+		var createQuery string
+		err := chConn.QueryRow(ctx, "SELECT create_table_query FROM system.tables WHERE database = currentDatabase() AND name = ?", t.name).Scan(&createQuery)
+		if err != nil {
+			log.Printf("Error reading TTL of %s: %v", t.name, err)
 			continue
 		}
+		// ClickHouse stores "INTERVAL n DAY" as toIntervalDay(n).
+		if strings.Contains(createQuery, fmt.Sprintf("TTL Timestamp + toIntervalDay(%d)", t.days)) {
+			continue
+		}
+		query := fmt.Sprintf("ALTER TABLE %s MODIFY TTL Timestamp + INTERVAL %d DAY SETTINGS materialize_ttl_after_modify = 0", t.name, t.days)
+		if err := chConn.Exec(ctx, query); err != nil {
+			log.Printf("Error applying %d day retention to %s: %v", t.days, t.name, err)
+			continue
+		}
+		log.Printf("Retention for %s set to %d days", t.name, t.days)
+	}
+}
 
-		chConn = conn
-		fmt.Println("Successfully connected to ClickHouse!")
-		return
+// retryConnect calls connect up to attempts times, 3 seconds apart.
+func retryConnect(name string, attempts int, connect func() error) error {
+	var err error
+	for i := 0; i < attempts; i++ {
+		if err = connect(); err == nil {
+			return nil
+		}
+		log.Printf("Error connecting to %s: %v. Retrying in 3 seconds...", name, err)
+		time.Sleep(3 * time.Second)
 	}
+	log.Printf("Could not connect to %s after several retries, continuing in the background: %v", name, err)
+	return err
+}
 
-	log.Fatalf("Could not connect to ClickHouse after several retries: %v", err)
+// retryConnectForever keeps calling connect with capped exponential backoff
+// until it succeeds, then runs onConnect.
+func retryConnectForever(name string, connect func() error, onConnect func()) {
+	backoff := 5 * time.Second
+	for {
+		time.Sleep(backoff)
+		err := connect()
+		if err == nil {
+			log.Printf("Successfully connected to %s.", name)
+			onConnect()
+			return
+		}
+		log.Printf("%s still unreachable, retrying in %v: %v", name, backoff, err)
+		backoff = min(backoff*2, time.Minute)
+	}
 }
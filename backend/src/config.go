@@ -0,0 +1,353 @@
+package sentinel
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the server settings. It is read from the JSON file named by
+// SENTINEL_CONFIG (if set) and then overridden by environment variables, so
+// a deployment can keep secrets out of the file.
+type Config struct {
+	ListenAddr  string           `json:"listenAddr"`  // SENTINEL_LISTEN_ADDR
+	DatabaseURL string           `json:"databaseUrl"` // DATABASE_URL
+	ClickHouse  ClickHouseConfig `json:"clickhouse"`
+	// CookieDomain is the Domain attribute of the session cookie; leave it
+	// empty for a host-only cookie. COOKIE_DOMAIN
+	CookieDomain string `json:"cookieDomain"`
+	// CORSOrigins are the origins allowed to call the dashboard API with
+	// credentials. CORS_ORIGINS (comma-separated)
+	CORSOrigins []string        `json:"corsOrigins"`
+	GeoIP       GeoIPConfig     `json:"geoip"`
+	Retention   RetentionConfig `json:"retention"`
+	// VisitTimeoutMinutes is the inactivity gap that ends a visit.
+	// VISIT_TIMEOUT_MINUTES
+	VisitTimeoutMinutes int `json:"visitTimeoutMinutes"`
+	// ExchangeRatesFile seeds currency rates at startup. EXCHANGE_RATES_FILE
+	ExchangeRatesFile string      `json:"exchangeRatesFile"`
+	Spool             SpoolConfig `json:"spool"`
+	// AutoMigrate applies pending schema migrations at startup. Turn it off
+	// to run `migrate up` as a separate deploy step. AUTO_MIGRATE
+	AutoMigrate bool            `json:"autoMigrate"`
+	RateLimit   RateLimitConfig `json:"rateLimit"`
+	Blocklists  BlocklistConfig `json:"blocklists"`
+	// TrustedProxies are the IPs and CIDRs of reverse proxies whose
+	// X-Forwarded-For header is believed. Requests from anywhere else are
+	// attributed to their peer address. TRUSTED_PROXIES (comma-separated)
+	TrustedProxies []string `json:"trustedProxies"`
+}
+
+// BlocklistConfig restricts where firewall blocklist subscriptions may be
+// fetched from.
+type BlocklistConfig struct {
+	// Dir is the only directory file sources may be read from; empty
+	// disables file sources. BLOCKLIST_DIR
+	Dir string `json:"dir"`
+	// AllowPrivateNetworks lets URL sources resolve to loopback, private
+	// and link-local addresses. BLOCKLIST_ALLOW_PRIVATE_NETWORKS
+	AllowPrivateNetworks bool `json:"allowPrivateNetworks"`
+}
+
+// RateLimitConfig controls automatic bans of IPs flooding /track. An IP
+// sending more than Requests hits to one site within WindowSeconds is banned
+// from that site for BanMinutes.
+type RateLimitConfig struct {
+	Enabled       bool `json:"enabled"`       // RATE_LIMIT_ENABLED
+	Requests      int  `json:"requests"`      // RATE_LIMIT_REQUESTS
+	WindowSeconds int  `json:"windowSeconds"` // RATE_LIMIT_WINDOW_SECONDS
+	BanMinutes    int  `json:"banMinutes"`    // RATE_LIMIT_BAN_MINUTES
+	// PersistBans stores bans in Postgres so they survive restarts and are
+	// shared between replicas. RATE_LIMIT_PERSIST_BANS
+	PersistBans bool `json:"persistBans"`
+}
+
+type ClickHouseConfig struct {
+	Addrs    []string `json:"addrs"`    // CLICKHOUSE_ADDRS (comma-separated host:port)
+	Database string   `json:"database"` // CLICKHOUSE_DATABASE
+	Username string   `json:"username"` // CLICKHOUSE_USERNAME
+	Password string   `json:"password"` // CLICKHOUSE_PASSWORD
+	TLS      bool     `json:"tls"`      // CLICKHOUSE_TLS
+	// TLSCAFile is a PEM bundle used instead of the system roots.
+	// CLICKHOUSE_TLS_CA_FILE
+	TLSCAFile string `json:"tlsCaFile"`
+	// TLSSkipVerify disables certificate verification; for testing only.
+	// CLICKHOUSE_TLS_SKIP_VERIFY
+	TLSSkipVerify bool `json:"tlsSkipVerify"`
+}
+
+type GeoIPConfig struct {
+	CountryDB string `json:"countryDb"` // GEOIP_COUNTRY_DB
+	ASNDB     string `json:"asnDb"`     // GEOIP_ASN_DB
+}
+
+// RetentionConfig sets how long raw data is kept in ClickHouse. Zero keeps
+// data indefinitely (an existing TTL is left untouched).
+type RetentionConfig struct {
+	EventsDays        int `json:"eventsDays"`        // RETENTION_EVENTS_DAYS
+	SessionReplayDays int `json:"sessionReplayDays"` // RETENTION_SESSION_REPLAY_DAYS
+}
+
+type SpoolConfig struct {
+	Dir   string `json:"dir"`   // SPOOL_DIR
+	MaxMB int    `json:"maxMb"` // SPOOL_MAX_MB
+}
+
+// config is the active configuration, set by LoadConfig.
+var config = defaultConfig()
+
+func defaultConfig() Config {
+	return Config{
+		ListenAddr:  ":6060",
+		DatabaseURL: "postgres://sentinel:password@db:5432/sentinel?sslmode=disable",
+		ClickHouse: ClickHouseConfig{
+			Addrs:    []string{"clickhouse:9000"},
+			Database: "sentinel",
+			Username: "sentinel",
+			Password: "password",
+		},
+		CookieDomain:        ".getmusterup.com",
+		CORSOrigins:         []string{"https://sentinel-mvp.getmusterup.com", "https://sentinel.getmusterup.com", "http://localhost:5173"},
+		GeoIP:               GeoIPConfig{CountryDB: "GeoLite2-Country.mmdb", ASNDB: "GeoLite2-ASN.mmdb"},
+		VisitTimeoutMinutes: 30,
+		Spool:               SpoolConfig{Dir: "./spool", MaxMB: 1024},
+		AutoMigrate:         true,
+		RateLimit: RateLimitConfig{
+			Enabled:       true,
+			Requests:      600,
+			WindowSeconds: 60,
+			BanMinutes:    60,
+			PersistBans:   true,
+		},
+		TrustedProxies: []string{"127.0.0.0/8", "::1/128", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"},
+	}
+}
+
+// LoadConfig reads the configuration file and environment, validates the
+// result and makes it the active configuration.
+func LoadConfig() (Config, error) {
+	cfg := defaultConfig()
+	if path := os.Getenv("SENTINEL_CONFIG"); path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return cfg, fmt.Errorf("reading config file: %w", err)
+		}
+		defer f.Close()
+		dec := json.NewDecoder(f)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&cfg); err != nil {
+			return cfg, fmt.Errorf("parsing config file %s: %w", path, err)
+		}
+	}
+	if err := cfg.applyEnv(); err != nil {
+		return cfg, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return cfg, err
+	}
+	config = cfg
+	VisitTimeout = time.Duration(cfg.VisitTimeoutMinutes) * time.Minute
+	trustedProxies, _ = parsePrefixes(cfg.TrustedProxies)
+	return cfg, nil
+}
+
+func (c *Config) applyEnv() error {
+	var errs []error
+	str := func(key string, dst *string) {
+		if v, ok := os.LookupEnv(key); ok {
+			*dst = v
+		}
+	}
+	list := func(key string, dst *[]string) {
+		if v, ok := os.LookupEnv(key); ok {
+			*dst = splitList(v)
+		}
+	}
+	integer := func(key string, dst *int) {
+		if v, ok := os.LookupEnv(key); ok {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %q is not an integer", key, v))
+				return
+			}
+			*dst = n
+		}
+	}
+	boolean := func(key string, dst *bool) {
+		if v, ok := os.LookupEnv(key); ok {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %q is not a boolean", key, v))
+				return
+			}
+			*dst = b
+		}
+	}
+
+	str("SENTINEL_LISTEN_ADDR", &c.ListenAddr)
+	str("DATABASE_URL", &c.DatabaseURL)
+	list("CLICKHOUSE_ADDRS", &c.ClickHouse.Addrs)
+	str("CLICKHOUSE_DATABASE", &c.ClickHouse.Database)
+	str("CLICKHOUSE_USERNAME", &c.ClickHouse.Username)
+	str("CLICKHOUSE_PASSWORD", &c.ClickHouse.Password)
+	boolean("CLICKHOUSE_TLS", &c.ClickHouse.TLS)
+	str("CLICKHOUSE_TLS_CA_FILE", &c.ClickHouse.TLSCAFile)
+	boolean("CLICKHOUSE_TLS_SKIP_VERIFY", &c.ClickHouse.TLSSkipVerify)
+	str("COOKIE_DOMAIN", &c.CookieDomain)
+	list("CORS_ORIGINS", &c.CORSOrigins)
+	str("GEOIP_COUNTRY_DB", &c.GeoIP.CountryDB)
+	str("GEOIP_ASN_DB", &c.GeoIP.ASNDB)
+	integer("RETENTION_EVENTS_DAYS", &c.Retention.EventsDays)
+	integer("RETENTION_SESSION_REPLAY_DAYS", &c.Retention.SessionReplayDays)
+	integer("VISIT_TIMEOUT_MINUTES", &c.VisitTimeoutMinutes)
+	str("EXCHANGE_RATES_FILE", &c.ExchangeRatesFile)
+	str("SPOOL_DIR", &c.Spool.Dir)
+	integer("SPOOL_MAX_MB", &c.Spool.MaxMB)
+	boolean("AUTO_MIGRATE", &c.AutoMigrate)
+	boolean("RATE_LIMIT_ENABLED", &c.RateLimit.Enabled)
+	integer("RATE_LIMIT_REQUESTS", &c.RateLimit.Requests)
+	integer("RATE_LIMIT_WINDOW_SECONDS", &c.RateLimit.WindowSeconds)
+	integer("RATE_LIMIT_BAN_MINUTES", &c.RateLimit.BanMinutes)
+	boolean("RATE_LIMIT_PERSIST_BANS", &c.RateLimit.PersistBans)
+	str("BLOCKLIST_DIR", &c.Blocklists.Dir)
+	boolean("BLOCKLIST_ALLOW_PRIVATE_NETWORKS", &c.Blocklists.AllowPrivateNetworks)
+	list("TRUSTED_PROXIES", &c.TrustedProxies)
+	return errors.Join(errs...)
+}
+
+func splitList(v string) []string {
+	var out []string
+	for _, part := range strings.Split(v, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+// Validate checks the configuration and reports every problem found.
+func (c Config) Validate() error {
+	var errs []error
+	fail := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if _, _, err := net.SplitHostPort(c.ListenAddr); err != nil {
+		fail("listenAddr: %q is not a host:port address", c.ListenAddr)
+	}
+	if u, err := url.Parse(c.DatabaseURL); err != nil || (u.Scheme != "postgres" && u.Scheme != "postgresql") || u.Host == "" {
+		fail("databaseUrl: must be a postgres:// URL")
+	}
+
+	if len(c.ClickHouse.Addrs) == 0 {
+		fail("clickhouse.addrs: at least one address is required")
+	}
+	for _, addr := range c.ClickHouse.Addrs {
+		if host, port, err := net.SplitHostPort(addr); err != nil || host == "" || port == "" {
+			fail("clickhouse.addrs: %q is not a host:port address", addr)
+		}
+	}
+	if c.ClickHouse.Database == "" {
+		fail("clickhouse.database: must not be empty")
+	}
+	if !c.ClickHouse.TLS && (c.ClickHouse.TLSCAFile != "" || c.ClickHouse.TLSSkipVerify) {
+		fail("clickhouse: tlsCaFile and tlsSkipVerify require tls to be enabled")
+	}
+	if c.ClickHouse.TLSCAFile != "" {
+		if _, err := os.Stat(c.ClickHouse.TLSCAFile); err != nil {
+			fail("clickhouse.tlsCaFile: %v", err)
+		}
+	}
+
+	if strings.ContainsAny(c.CookieDomain, "/: ") {
+		fail("cookieDomain: %q must be a bare domain such as .example.com", c.CookieDomain)
+	}
+	for _, origin := range c.CORSOrigins {
+		if origin == "*" {
+			fail("corsOrigins: \"*\" is not allowed because the API accepts credentials")
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			fail("corsOrigins: %q must be a scheme://host[:port] origin", origin)
+		}
+	}
+
+	if c.Retention.EventsDays < 0 {
+		fail("retention.eventsDays: must not be negative")
+	}
+	if c.Retention.SessionReplayDays < 0 {
+		fail("retention.sessionReplayDays: must not be negative")
+	}
+	if c.VisitTimeoutMinutes <= 0 {
+		fail("visitTimeoutMinutes: must be positive")
+	}
+	if c.ExchangeRatesFile != "" {
+		if _, err := os.Stat(c.ExchangeRatesFile); err != nil {
+			fail("exchangeRatesFile: %v", err)
+		}
+	}
+	if c.Spool.Dir == "" {
+		fail("spool.dir: must not be empty")
+	}
+	if c.Spool.MaxMB <= 0 {
+		fail("spool.maxMb: must be positive")
+	}
+	if c.RateLimit.Enabled {
+		if c.RateLimit.Requests <= 0 {
+			fail("rateLimit.requests: must be positive")
+		}
+		if c.RateLimit.WindowSeconds <= 0 {
+			fail("rateLimit.windowSeconds: must be positive")
+		}
+		if c.RateLimit.BanMinutes <= 0 {
+			fail("rateLimit.banMinutes: must be positive")
+		}
+	}
+	if c.Blocklists.Dir != "" {
+		if fi, err := os.Stat(c.Blocklists.Dir); err != nil {
+			fail("blocklists.dir: %v", err)
+		} else if !fi.IsDir() {
+			fail("blocklists.dir: %s is not a directory", c.Blocklists.Dir)
+		}
+	}
+
+	if _, err := parsePrefixes(c.TrustedProxies); err != nil {
+		fail("trustedProxies: %v", err)
+	}
+
+	// Missing GeoIP databases only degrade lookups, so they are not fatal.
+	for name, path := range map[string]string{"geoip.countryDb": c.GeoIP.CountryDB, "geoip.asnDb": c.GeoIP.ASNDB} {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			log.Printf("Warning: %s: %v", name, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// parsePrefixes parses IP addresses and CIDRs, treating an address as a
+// single-host prefix.
+func parsePrefixes(values []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, v := range values {
+		if p, err := netip.ParsePrefix(v); err == nil {
+			prefixes = append(prefixes, p.Masked())
+		} else if addr, err := netip.ParseAddr(v); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+		} else {
+			return nil, fmt.Errorf("%q is not an IP address or CIDR", v)
+		}
+	}
+	return prefixes, nil
+}
@@ -6,8 +6,6 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
-	"os"
-	"strconv"
 	"time"
 
 	"github.com/lib/pq"
@@ -16,82 +14,54 @@ import (
 
 var db *sql.DB
 
-// ... (InitDB and createTables are unchanged) ...
 func InitDB() {
-	connStr := os.Getenv("DATABASE_URL")
-	if connStr == "" {
-		connStr = "postgres://sentinel:password@db:5432/sentinel?sslmode=disable"
-		log.Println("DATABASE_URL not found, using default Docker connection string.")
-	}
-	var err error
-	db, err = sql.Open("postgres", connStr)
-	if err != nil {
+	if err := openDatabase(); err != nil {
 		log.Fatalf("Error opening database: %q", err)
 	}
-	for i := 0; i < 5; i++ {
-		err = db.Ping()
-		if err == nil {
-			break
+	connect := func() error {
+		if err := db.Ping(); err != nil {
+			return err
 		}
-		log.Printf("Database not ready, retrying in 2 seconds... (%v)", err)
-		time.Sleep(2 * time.Second)
+		return runStartupMigrations(storePostgres)
 	}
-	if err != nil {
-		log.Fatalf("Could not connect to the database after several retries: %q", err)
+	if err := retryConnect("the database", 5, connect); err != nil {
+		go retryConnectForever("the database", connect, databaseReady)
+		return
 	}
 	log.Println("Successfully connected to the database.")
-	createTables()
+	databaseReady()
 }
 
-func createTables() {
-	enableExtension := `CREATE EXTENSION IF NOT EXISTS "pgcrypto";`
-	if _, err := db.Exec(enableExtension); err != nil {
-		log.Fatalf("Could not enable pgcrypto extension: %v", err)
-	}
-	createUsersTable := `
-    CREATE TABLE IF NOT EXISTS users (
-        id SERIAL PRIMARY KEY,
-        email TEXT NOT NULL UNIQUE,
-        password_hash TEXT NOT NULL,
-        created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
-    );`
-	if _, err := db.Exec(createUsersTable); err != nil {
-		log.Fatalf("Could not create users table: %v", err)
-	}
-	createSitesTable := `
-    CREATE TABLE IF NOT EXISTS sites (
-        id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
-        user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
-        name TEXT NOT NULL,
-        domain TEXT,
-        created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
-    );`
-	if _, err := db.Exec(createSitesTable); err != nil {
-		log.Fatalf("Could not create sites table: %v", err)
+func openDatabase() error {
+	var err error
+	db, err = sql.Open("postgres", config.DatabaseURL)
+	return err
+}
+
+// databaseReady runs once the database is reachable and migrated.
+func databaseReady() {
+	dbReady.Store(true)
+	listenForFirewallChanges()
+	StartRateLimiter()
+	startFirewallMaintenance()
+	startBlocklistSync()
+	seedExchangeRates()
+}
+
+// runStartupMigrations applies pending migrations of store at boot unless
+// Config.AutoMigrate is off.
+func runStartupMigrations(store string) error {
+	if !config.AutoMigrate {
+		return nil
 	}
-	createFirewallRulesTable := `
-    CREATE TABLE IF NOT EXISTS firewall_rules (
-        id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
-        site_id UUID NOT NULL REFERENCES sites(id) ON DELETE CASCADE,
-        rule_type TEXT NOT NULL, -- e.g., "ip", "country", "asn"
-        value TEXT NOT NULL,
-        created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
-    );`
-	if _, err := db.Exec(createFirewallRulesTable); err != nil {
-		log.Fatalf("Could not create firewall_rules table: %v", err)
+	n, err := migrateUp(context.Background(), store, 0)
+	if err != nil {
+		return err
 	}
-	createFunnelsTable := `
-    CREATE TABLE IF NOT EXISTS funnels (
-        id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
-        site_id UUID NOT NULL REFERENCES sites(id) ON DELETE CASCADE,
-        name TEXT NOT NULL,
-        steps JSONB NOT NULL,
-        created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
-    );`
-	if _, err := db.Exec(createFunnelsTable); err != nil {
-		log.Fatalf("Could not create funnels table: %v", err)
+	if n > 0 {
+		log.Printf("Applied %d %s migration(s)", n, store)
 	}
-	log.Println("Database tables are set up.")
+	return nil
 }
 
 
@@ -109,17 +79,18 @@ func checkPasswordHash(password, hash string) bool {
 
 func AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		cookie, err := r.Cookie("sentinel_session")
+		cookie, err := r.Cookie(sessionCookieName)
 		if err != nil {
 			http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
 			return
 		}
-		userID, err := strconv.Atoi(cookie.Value)
-		if err != nil || userID == 0 {
+		sessionID, userID, err := lookupSession(cookie.Value)
+		if err != nil {
 			http.Error(w, `{"error": "Unauthorized"}`, http.StatusUnauthorized)
 			return
 		}
 		ctx := context.WithValue(r.Context(), "userID", userID)
+		ctx = context.WithValue(ctx, "sessionID", sessionID)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	}
 }
@@ -175,16 +146,13 @@ func SignupHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Set session cookie upon successful signup
-	http.SetCookie(w, &http.Cookie{
-		Name:     "sentinel_session",
-		Value:    strconv.Itoa(userID),
-		Path:     "/",
-		Expires:  time.Now().Add(24 * time.Hour),
-		HttpOnly: true,
-		Secure:   true, // Important for cross-domain
-		SameSite: http.SameSiteNoneMode,
-		Domain:   ".getmusterup.com", // Set to the parent domain
-	})
+	token, expiresAt, err := createSession(userID, r)
+	if err != nil {
+		log.Printf("Error creating session: %v", err)
+		http.Error(w, `{"error": "An unexpected error occurred"}`, http.StatusInternalServerError)
+		return
+	}
+	setSessionCookie(w, token, expiresAt)
 
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(map[string]string{"message": "User created successfully"})
@@ -224,36 +192,52 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, `{"error": "Incorrect password"}`, http.StatusUnauthorized)
 		return
 	}
-	http.SetCookie(w, &http.Cookie{
-		Name:     "sentinel_session",
-		Value:    strconv.Itoa(userID),
-		Path:     "/",
-		Expires:  time.Now().Add(24 * time.Hour),
-		HttpOnly: true,
-		Secure:   true, // Important for cross-domain
-		SameSite: http.SameSiteNoneMode,
-		Domain:   ".getmusterup.com", // Set to the parent domain
-	})
+
+	// Rotate: any session the browser already holds is replaced by a fresh one.
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		revokeSession(cookie.Value)
+	}
+	token, expiresAt, err := createSession(userID, r)
+	if err != nil {
+		log.Printf("Error creating session: %v", err)
+		http.Error(w, `{"error": "Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	setSessionCookie(w, token, expiresAt)
 
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{"message": "Login successful"})
 }
 
 func LogoutHandler(w http.ResponseWriter, r *http.Request) {
-	http.SetCookie(w, &http.Cookie{
-		Name:     "sentinel_session",
-		Value:    "",
-		Path:     "/",
-		Expires:  time.Unix(0, 0),
-		HttpOnly: true,
-		Secure:   true,
-		SameSite: http.SameSiteNoneMode,
-		Domain:   ".getmusterup.com",
-	})
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		if err := revokeSession(cookie.Value); err != nil {
+			log.Printf("Error revoking session: %v", err)
+		}
+	}
+	clearSessionCookie(w)
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{"message": "Logged out"})
 }
 
+// LogoutAllHandler revokes every session of the current user, signing them
+// out on all devices including this one.
+func LogoutAllHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := r.Context().Value("userID").(int)
+	if _, err := db.Exec("DELETE FROM sessions WHERE user_id = $1", userID); err != nil {
+		log.Printf("Error revoking sessions for user %d: %v", userID, err)
+		http.Error(w, `{"error": "Internal server error"}`, http.StatusInternalServerError)
+		return
+	}
+	clearSessionCookie(w)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Logged out of all devices"})
+}
+
 func HomeHandler(w http.ResponseWriter, r *http.Request) {
 	// This will be handled by the React app's routing
 }
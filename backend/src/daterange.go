@@ -0,0 +1,98 @@
+package sentinel
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+	_ "time/tzdata" // the runtime image ships without a zoneinfo database
+)
+
+const maxRangeDays = 5 * 366
+
+// DateRange is a half-open [From, To) reporting window interpreted in Location.
+type DateRange struct {
+	From     time.Time
+	To       time.Time
+	Location *time.Location
+}
+
+// Previous returns the equally long window immediately preceding dr, used
+// for period-over-period comparisons.
+func (dr DateRange) Previous() DateRange {
+	return DateRange{From: dr.From.Add(-dr.To.Sub(dr.From)), To: dr.From, Location: dr.Location}
+}
+
+// siteDateRange parses the request's date range, defaulting the time zone to
+// the one configured for the site.
+func siteDateRange(r *http.Request, siteID string) (DateRange, error) {
+	defaultTZ := ""
+	if settings, err := getSiteSettings(siteID); err == nil {
+		defaultTZ = settings.Timezone
+	}
+	return parseDateRange(r.URL.Query(), defaultTZ)
+}
+
+// parseDateRange reads from/to (ISO dates or RFC 3339 timestamps) and tz
+// from the query string. Dates are whole days in tz, with to inclusive.
+// Without from/to the range covers the last `days` days (default 30).
+func parseDateRange(q url.Values, defaultTZ string) (DateRange, error) {
+	var dr DateRange
+
+	tz := q.Get("tz")
+	if tz == "" {
+		tz = defaultTZ
+	}
+	if tz == "" {
+		tz = "UTC"
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return dr, fmt.Errorf("invalid tz %q", tz)
+	}
+	dr.Location = loc
+
+	fromStr, toStr := q.Get("from"), q.Get("to")
+	if fromStr == "" && toStr == "" {
+		days, err := strconv.Atoi(q.Get("days"))
+		if err != nil || days <= 0 {
+			days = 30 // Default to 30 days
+		}
+		dr.To = time.Now().In(loc)
+		dr.From = dr.To.AddDate(0, 0, -days)
+		return dr, nil
+	}
+	if fromStr == "" || toStr == "" {
+		return dr, fmt.Errorf("from and to must be given together")
+	}
+	if dr.From, err = parseRangeBound(fromStr, loc, false); err != nil {
+		return dr, fmt.Errorf("invalid from: %v", err)
+	}
+	if dr.To, err = parseRangeBound(toStr, loc, true); err != nil {
+		return dr, fmt.Errorf("invalid to: %v", err)
+	}
+	if !dr.From.Before(dr.To) {
+		return dr, fmt.Errorf("from must be before to")
+	}
+	if dr.To.Sub(dr.From) > maxRangeDays*24*time.Hour {
+		return dr, fmt.Errorf("date range cannot exceed %d days", maxRangeDays)
+	}
+	return dr, nil
+}
+
+// parseRangeBound parses an ISO date or timestamp. A bare date used as the end
+// of a range is inclusive, so it resolves to midnight of the following day.
+func parseRangeBound(s string, loc *time.Location, end bool) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", s, loc); err == nil {
+		if end {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return t, fmt.Errorf("expected YYYY-MM-DD or RFC 3339, got %q", s)
+	}
+	return t.In(loc), nil
+}
@@ -0,0 +1,149 @@
+package sentinel
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+const (
+	pageviewEventName = "pageview"
+	maxEventNameLen   = 120
+	maxEventProps     = 30
+	maxPropKeyLen     = 300
+	maxPropValueLen   = 2000
+)
+
+// EventBreakdown summarises one custom event name and its most common property values.
+type EventBreakdown struct {
+	Name       string                 `json:"name"`
+	Count      uint64                 `json:"count"`
+	Visitors   uint64                 `json:"visitors"`
+	Properties map[string][]CountStat `json:"properties"`
+}
+
+// normalizeCustomEvent fills in the default event name and enforces the size
+// limits on custom event names and properties.
+func normalizeCustomEvent(event *Event) error {
+	event.Name = strings.TrimSpace(event.Name)
+	if event.Name == "" {
+		event.Name = pageviewEventName
+	}
+	if len(event.Name) > maxEventNameLen {
+		return fmt.Errorf("event name must be at most %d characters", maxEventNameLen)
+	}
+	if len(event.Props) > maxEventProps {
+		return fmt.Errorf("events may have at most %d properties", maxEventProps)
+	}
+	for k, v := range event.Props {
+		if k == "" || len(k) > maxPropKeyLen {
+			return fmt.Errorf("property names must be 1-%d characters", maxPropKeyLen)
+		}
+		if len(v) > maxPropValueLen {
+			return fmt.Errorf("property %q must be at most %d characters", k, maxPropValueLen)
+		}
+	}
+	if event.Props == nil {
+		event.Props = map[string]string{}
+	}
+	return nil
+}
+
+// @Summary Custom event breakdown
+// @Description List the top custom event names for a site and the top values of each of their properties.
+// @Tags events
+// @Produce  json
+// @Param siteId query string true "Site ID"
+// @Param from query string false "Start date (YYYY-MM-DD or RFC 3339)"
+// @Param to query string false "End date, inclusive (YYYY-MM-DD or RFC 3339)"
+// @Param tz query string false "IANA time zone (defaults to the site's time zone)"
+// @Param days query int false "Number of days to report on when from/to are not given (default 30)"
+// @Success 200 {array} EventBreakdown
+// @Router /api/events [get]
+func EventsBreakdownHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	siteID := r.URL.Query().Get("siteId")
+	if siteID == "" {
+		http.Error(w, "siteId query parameter is required", http.StatusBadRequest)
+		return
+	}
+	if !canAccessSite(r, siteID, ScopeStatsRead) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	dr, err := siteDateRange(r, siteID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	breakdown, err := queryEventBreakdown(context.Background(), siteID, dr)
+	if err != nil {
+		log.Printf("Error querying event breakdown: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(breakdown)
+}
+
+func queryEventBreakdown(ctx context.Context, siteID string, dr DateRange) ([]EventBreakdown, error) {
+	result := []EventBreakdown{}
+	rows, err := chConn.Query(ctx, `
+		SELECT EventName, count() AS c, uniq(VisitorID)
+		FROM events
+		WHERE SiteID = ? AND EventName != ? AND Timestamp >= ? AND Timestamp < ? AND NOT Filtered
+		GROUP BY EventName
+		ORDER BY c DESC
+		LIMIT 25`, siteID, pageviewEventName, dr.From.UTC(), dr.To.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	index := map[string]int{}
+	var names []string
+	for rows.Next() {
+		e := EventBreakdown{Properties: map[string][]CountStat{}}
+		if err := rows.Scan(&e.Name, &e.Count, &e.Visitors); err != nil {
+			return nil, err
+		}
+		index[e.Name] = len(result)
+		names = append(names, e.Name)
+		result = append(result, e)
+	}
+	if len(names) == 0 {
+		return result, nil
+	}
+
+	propRows, err := chConn.Query(ctx, `
+		SELECT EventName, key, value, count() AS c
+		FROM events
+		ARRAY JOIN mapKeys(Props) AS key, mapValues(Props) AS value
+		WHERE SiteID = ? AND EventName IN (?) AND Timestamp >= ? AND Timestamp < ? AND NOT Filtered
+		GROUP BY EventName, key, value
+		ORDER BY c DESC
+		LIMIT 10 BY EventName, key`, siteID, names, dr.From.UTC(), dr.To.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer propRows.Close()
+
+	for propRows.Next() {
+		var name, key string
+		var stat CountStat
+		if err := propRows.Scan(&name, &key, &stat.Value, &stat.Count); err != nil {
+			return nil, err
+		}
+		e := &result[index[name]]
+		e.Properties[key] = append(e.Properties[key], stat)
+	}
+	return result, nil
+}
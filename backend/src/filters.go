@@ -0,0 +1,97 @@
+package sentinel
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// filterDimensions maps the dimension names accepted in filters to their
+// ClickHouse columns.
+var filterDimensions = map[string]string{
+	"country":      "Country",
+	"browser":      "Browser",
+	"os":           "OS",
+	"page":         "URL",
+	"referrer":     "Referrer",
+	"source":       "Source",
+	"medium":       "Medium",
+	"utm_campaign": "UTMCampaign",
+}
+
+// Filter restricts stats to events whose Dimension matches Value under Operator
+// ("is", "is_not" or "contains").
+type Filter struct {
+	Dimension string `json:"dimension"`
+	Operator  string `json:"operator"`
+	Value     string `json:"value"`
+}
+
+// StatsQuery scopes a stats computation to a site, a date range and a set of
+// filters that are combined with AND.
+type StatsQuery struct {
+	SiteID  string
+	Range   DateRange
+	Filters []Filter
+}
+
+// parseFilters reads repeated filter=dimension:operator:value parameters,
+// e.g. filter=country:is:DE&filter=page:contains:/blog.
+func parseFilters(q url.Values) ([]Filter, error) {
+	var filters []Filter
+	for _, raw := range q["filter"] {
+		parts := strings.SplitN(raw, ":", 3)
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid filter %q, expected dimension:operator:value", raw)
+		}
+		f := Filter{Dimension: parts[0], Operator: parts[1], Value: parts[2]}
+		if _, ok := filterDimensions[f.Dimension]; !ok {
+			return nil, fmt.Errorf("invalid filter dimension %q. Must be 'country', 'browser', 'os', 'page', 'referrer', 'source', 'medium', or 'utm_campaign'", f.Dimension)
+		}
+		switch f.Operator {
+		case "is", "is_not", "contains":
+		default:
+			return nil, fmt.Errorf("invalid filter operator %q. Must be 'is', 'is_not', or 'contains'", f.Operator)
+		}
+		filters = append(filters, f)
+	}
+	return filters, nil
+}
+
+// condition renders the filter as a parameterized ClickHouse expression.
+// Pages match on either the full URL or its path.
+func (f Filter) condition() (string, []any) {
+	column := filterDimensions[f.Dimension]
+	var cond string
+	var args []any
+	switch {
+	case f.Operator == "contains":
+		return "positionCaseInsensitiveUTF8(" + column + ", ?) > 0", []any{f.Value}
+	case f.Dimension == "page":
+		cond, args = "(URL = ? OR path(URL) = ?)", []any{f.Value, f.Value}
+	default:
+		cond, args = column+" = ?", []any{f.Value}
+	}
+	if f.Operator == "is_not" {
+		cond = "NOT " + cond
+	}
+	return cond, args
+}
+
+// where returns the WHERE clause selecting the query's events, leaving out
+// hits tagged by the firewall, and its bind arguments.
+func (q StatsQuery) where() (string, []any) {
+	clauses := []string{"SiteID = ?", "Timestamp >= ?", "Timestamp < ?", "NOT Filtered"}
+	args := []any{q.SiteID, q.Range.From.UTC(), q.Range.To.UTC()}
+	for _, f := range q.Filters {
+		cond, fArgs := f.condition()
+		clauses = append(clauses, cond)
+		args = append(args, fArgs...)
+	}
+	return strings.Join(clauses, " AND "), args
+}
+
+// previous returns the same query over the preceding period.
+func (q StatsQuery) previous() StatsQuery {
+	return StatsQuery{SiteID: q.SiteID, Range: q.Range.Previous(), Filters: q.Filters}
+}
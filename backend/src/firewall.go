@@ -1,19 +1,66 @@
 package sentinel
 
 import (
-	_ "database/sql"
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
+)
+
+// Firewall rule types
+const (
+	RuleIP           = "ip"
+	RuleCountry      = "country"
+	RuleASN          = "asn"
+	RuleUserAgent    = "user_agent"    // substring, or a regex wrapped in slashes
+	RuleReferrerHost = "referrer_host" // referrer host, including its subdomains
+	RulePath         = "path"          // glob on the page path, "*" matches anything
+	RuleHostname     = "hostname"      // host of the tracked page; "*.example.com" matches subdomains
+	RuleTrustBelow   = "trust_below"   // hits with a trust score below the value (1-100)
+)
+
+// maxFirewallPatternLength bounds user agent and path patterns.
+const maxFirewallPatternLength = 512
+
+// maxFirewallNoteLength bounds the free-text note on a rule.
+const maxFirewallNoteLength = 1000
+
+// Firewall rule actions
+const (
+	ActionBlock   = "block"    // reject the hit
+	ActionAllow   = "allow"    // accept the hit, overriding lower-priority blocks
+	ActionLogOnly = "log_only" // dry run: record the match, take no action
+	ActionTag     = "tag"      // store the hit but exclude it from stats
+	// ActionChallenge marks suspicious traffic. /track answers a beacon, not
+	// a page, so it cannot put a challenge in front of the visitor; the hit
+	// is stored but excluded from stats like tag, and listed in the
+	// firewall log for review.
+	ActionChallenge = "challenge"
 )
 
 type FirewallRule struct {
 	ID       string `json:"id"`
 	SiteID   string `json:"siteId"`
-	RuleType string `json:"rule_type"` // e.g., "ip", "country", "asn"
-	Value    string `json:"value"`     // The actual IP, country code, or ASN
+	RuleType string `json:"rule_type"` // e.g., "ip", "country", "asn", "user_agent", "path"
+	Value    string `json:"value"`     // The IP, country code, ASN, pattern, host or threshold
+	Action   string `json:"action"`    // "block" (default), "allow", "challenge", "log_only" or "tag"
+	Priority int    `json:"priority"`  // lower numbers are evaluated first
+
+	ExpiresAt *time.Time `json:"expires_at,omitempty"` // the rule is deleted after this time
+	Note      string     `json:"note"`                 // why the rule exists
+
+	// Read-only fields, returned when listing rules
+	CreatedBy   *int       `json:"created_by,omitempty"`
+	BlocklistID *string    `json:"blocklist_id,omitempty"` // set on rules synced from a blocklist subscription
+	CreatedAt   time.Time  `json:"created_at"`
+	Hits        int64      `json:"hits"`     // matches since the rule was created
+	Hits24h     int64      `json:"hits_24h"` // matches in the last 24 hours
+	LastHitAt   *time.Time `json:"last_hit_at,omitempty"`
 }
 
 // FirewallApiHandler routes requests to appropriate functions based on HTTP method.
@@ -23,6 +70,8 @@ func FirewallApiHandler(w http.ResponseWriter, r *http.Request) {
 		handleListFirewallRules(w, r)
 	case "POST":
 		handleCreateFirewallRule(w, r)
+	case "PUT":
+		handleUpdateFirewallRule(w, r)
 	case "DELETE":
 		handleDeleteFirewallRule(w, r)
 	default:
@@ -30,15 +79,97 @@ func FirewallApiHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// validateFirewallRule checks the rule's type, value and action, defaulting
+// the action to block.
+func validateFirewallRule(rule *FirewallRule) error {
+	switch rule.RuleType {
+	case RuleIP:
+		if net.ParseIP(rule.Value) == nil {
+			if _, _, err := net.ParseCIDR(rule.Value); err != nil {
+				return errors.New("Invalid IP address or CIDR")
+			}
+		}
+	case RuleCountry:
+		if len(rule.Value) != 2 {
+			return errors.New("Country code must be 2 characters (ISO 3166-1 alpha-2)")
+		}
+		rule.Value = strings.ToUpper(rule.Value)
+	case RuleASN:
+		// ASN values are typically numbers, but can be prefixed with AS. Simple check for now.
+		if !strings.HasPrefix(strings.ToUpper(rule.Value), "AS") {
+			// Attempt to parse as integer if no AS prefix
+			if _, err := strconv.Atoi(rule.Value); err != nil {
+				return errors.New("Invalid ASN value")
+			}
+		}
+	case RuleUserAgent:
+		if rule.Value == "" || len(rule.Value) > maxFirewallPatternLength {
+			return fmt.Errorf("User agent pattern must be 1-%d characters", maxFirewallPatternLength)
+		}
+		if _, err := compileUserAgentPattern(rule.Value); err != nil {
+			return fmt.Errorf("Invalid user agent regex: %v", err)
+		}
+	case RulePath:
+		if !strings.HasPrefix(rule.Value, "/") || len(rule.Value) > maxFirewallPatternLength {
+			return fmt.Errorf("Path pattern must start with '/' and be at most %d characters", maxFirewallPatternLength)
+		}
+	case RuleReferrerHost:
+		rule.Value = strings.ToLower(strings.TrimSpace(rule.Value))
+		if !isHostname(rule.Value) {
+			return errors.New("Referrer host must be a domain name such as spam.example")
+		}
+	case RuleHostname:
+		rule.Value = strings.ToLower(strings.TrimSpace(rule.Value))
+		if !isHostname(strings.TrimPrefix(rule.Value, "*.")) {
+			return errors.New("Hostname must be a host such as staging.example.com or *.example.com")
+		}
+	case RuleTrustBelow:
+		n, err := strconv.Atoi(strings.TrimSpace(rule.Value))
+		if err != nil || n < 1 || n > 100 {
+			return errors.New("Trust threshold must be a whole number from 1 to 100")
+		}
+		rule.Value = strconv.Itoa(n)
+	default:
+		return errors.New("Invalid rule type. Must be 'ip', 'country', 'asn', 'user_agent', 'referrer_host', 'path', 'hostname', or 'trust_below'")
+	}
+
+	if rule.Action == "" {
+		rule.Action = ActionBlock
+	}
+	if _, ok := actionRank[rule.Action]; !ok {
+		return errors.New("Invalid action. Must be 'block', 'allow', 'challenge', 'log_only', or 'tag'")
+	}
+	if rule.ExpiresAt != nil && !rule.ExpiresAt.After(time.Now()) {
+		return errors.New("expires_at must be in the future")
+	}
+	if len(rule.Note) > maxFirewallNoteLength {
+		return fmt.Errorf("Note must be at most %d characters", maxFirewallNoteLength)
+	}
+	return nil
+}
+
+// isHostname reports whether s looks like a DNS name or "localhost".
+func isHostname(s string) bool {
+	if s == "" || len(s) > 253 || strings.ContainsAny(s, "/:*? ") {
+		return false
+	}
+	for _, label := range strings.Split(s, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+	}
+	return true
+}
+
 // @Summary List firewall rules
-// @Description Get a list of all firewall rules for a specific site.
+// @Description Get a list of all firewall rules for a specific site, in evaluation order, with hit counts. Rules managed by blocklist subscriptions are only listed when blocklistId is given.
 // @Tags firewall
 // @Produce  json
 // @Param siteId query string true "Site ID"
+// @Param blocklistId query string false "List the rules synced from this blocklist instead"
 // @Success 200 {array} FirewallRule
 // @Router /api/firewall [get]
 func handleListFirewallRules(w http.ResponseWriter, r *http.Request) {
-	userID := r.Context().Value("userID").(int)
 	siteID := r.URL.Query().Get("siteId")
 	if siteID == "" {
 		http.Error(w, "siteId query parameter is required", http.StatusBadRequest)
@@ -46,35 +177,72 @@ func handleListFirewallRules(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Verify site ownership
-	var ownerID int
-	err := db.QueryRow("SELECT user_id FROM sites WHERE id = $1", siteID).Scan(&ownerID)
-	if err != nil || ownerID != userID {
+	if !canAccessSite(r, siteID, ScopeFirewallManage) {
 		http.Error(w, "Forbidden", http.StatusForbidden)
 		return
 	}
 
-	rows, err := db.Query("SELECT id, site_id, rule_type, value FROM firewall_rules WHERE site_id = $1 ORDER BY rule_type, value", siteID)
+	var rules []FirewallRule
+	var err error
+	if blocklistID := r.URL.Query().Get("blocklistId"); blocklistID != "" {
+		rules, err = queryFirewallRules("r.site_id = $1 AND r.blocklist_id = $2", siteID, blocklistID)
+	} else {
+		rules, err = queryFirewallRules("r.site_id = $1 AND r.blocklist_id IS NULL", siteID)
+	}
 	if err != nil {
 		http.Error(w, "Failed to fetch firewall rules", http.StatusInternalServerError)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rules)
+}
+
+// queryFirewallRules returns unexpired rules matching condition, on the
+// firewall_rules alias r, together with their hit counters.
+func queryFirewallRules(condition string, args ...any) ([]FirewallRule, error) {
+	rows, err := db.Query(`
+		SELECT r.id, r.site_id, r.rule_type, r.value, r.action, r.priority, r.expires_at, r.note, r.created_by, r.blocklist_id, r.created_at,
+			COALESCE(s.hits, 0), s.last_hit_at,
+			(SELECT COALESCE(sum(h.hits), 0) FROM firewall_rule_hits h WHERE h.rule_id = r.id AND h.hour > now() - interval '24 hours')
+		FROM firewall_rules r
+		LEFT JOIN firewall_rule_stats s ON s.rule_id = r.id
+		WHERE `+condition+` AND (r.expires_at IS NULL OR r.expires_at > now())
+		ORDER BY r.priority, r.rule_type, r.value`, args...)
+	if err != nil {
+		return nil, err
+	}
 	defer rows.Close()
 
 	rules := []FirewallRule{}
 	for rows.Next() {
 		var rule FirewallRule
-		if err := rows.Scan(&rule.ID, &rule.SiteID, &rule.RuleType, &rule.Value); err != nil {
-			http.Error(w, "Failed to scan firewall rule", http.StatusInternalServerError)
-			return
+		var expiresAt, lastHitAt sql.NullTime
+		var createdBy sql.NullInt64
+		var blocklistID sql.NullString
+		if err := rows.Scan(&rule.ID, &rule.SiteID, &rule.RuleType, &rule.Value, &rule.Action, &rule.Priority,
+			&expiresAt, &rule.Note, &createdBy, &blocklistID, &rule.CreatedAt, &rule.Hits, &lastHitAt, &rule.Hits24h); err != nil {
+			return nil, err
+		}
+		if expiresAt.Valid {
+			rule.ExpiresAt = &expiresAt.Time
+		}
+		if lastHitAt.Valid {
+			rule.LastHitAt = &lastHitAt.Time
+		}
+		if createdBy.Valid {
+			id := int(createdBy.Int64)
+			rule.CreatedBy = &id
+		}
+		if blocklistID.Valid {
+			rule.BlocklistID = &blocklistID.String
 		}
 		rules = append(rules, rule)
 	}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(rules)
+	return rules, rows.Err()
 }
 
 // @Summary Create a new firewall rule
-// @Description Add a new firewall rule for a site.
+// @Description Add a new firewall rule for a site. Use action "log_only" to try a rule out before blocking, and expires_at for a temporary rule.
 // @Tags firewall
 // @Accept  json
 // @Produce  json
@@ -82,7 +250,6 @@ func handleListFirewallRules(w http.ResponseWriter, r *http.Request) {
 // @Success 201 {object} FirewallRule
 // @Router /api/firewall [post]
 func handleCreateFirewallRule(w http.ResponseWriter, r *http.Request) {
-	userID := r.Context().Value("userID").(int)
 	siteID := r.URL.Query().Get("siteId")
 	if siteID == "" {
 		http.Error(w, "siteId query parameter is required", http.StatusBadRequest)
@@ -96,53 +263,97 @@ func handleCreateFirewallRule(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Verify site ownership
-	var ownerID int
-	err := db.QueryRow("SELECT user_id FROM sites WHERE id = $1", siteID).Scan(&ownerID)
-	if err != nil || ownerID != userID {
+	if !canAccessSite(r, siteID, ScopeFirewallManage) {
 		http.Error(w, "Forbidden", http.StatusForbidden)
 		return
 	}
 
-	// Basic validation for rule type and value
-	switch rule.RuleType {
-	case "ip":
-		if net.ParseIP(rule.Value) == nil && !strings.Contains(rule.Value, "/") {
-			http.Error(w, "Invalid IP address or CIDR", http.StatusBadRequest)
-			return
-		}
-	case "country":
-		if len(rule.Value) != 2 {
-			http.Error(w, "Country code must be 2 characters (ISO 3166-1 alpha-2)", http.StatusBadRequest)
-			return
-		}
-	case "asn":
-		// ASN values are typically numbers, but can be prefixed with AS. Simple check for now.
-		if !strings.HasPrefix(strings.ToUpper(rule.Value), "AS") {
-			// Attempt to parse as integer if no AS prefix
-			if _, err := strconv.Atoi(rule.Value); err != nil {
-				http.Error(w, "Invalid ASN value", http.StatusBadRequest)
-				return
-			}
-		}
-	default:
-		http.Error(w, "Invalid rule type. Must be 'ip', 'country', or 'asn'", http.StatusBadRequest)
+	if err := validateFirewallRule(&rule); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
+	userID := r.Context().Value("userID").(int)
 	var newRuleID string
-	err = db.QueryRow("INSERT INTO firewall_rules (site_id, rule_type, value) VALUES ($1, $2, $3) RETURNING id", siteID, rule.RuleType, rule.Value).Scan(&newRuleID)
+	err := db.QueryRow(`INSERT INTO firewall_rules (site_id, rule_type, value, action, priority, expires_at, note, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id, created_at`,
+		siteID, rule.RuleType, rule.Value, rule.Action, rule.Priority, rule.ExpiresAt, rule.Note, userID).Scan(&newRuleID, &rule.CreatedAt)
 	if err != nil {
 		http.Error(w, "Failed to create firewall rule", http.StatusInternalServerError)
 		return
 	}
+	firewallRules.invalidate(siteID)
 
 	rule.ID = newRuleID
 	rule.SiteID = siteID
+	rule.CreatedBy = &userID
+	rule.Hits, rule.Hits24h, rule.LastHitAt = 0, 0, nil
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(rule)
 }
 
+// @Summary Update a firewall rule
+// @Description Replace a rule's type, value, action, priority, expiry and note, e.g. to promote a log_only rule to block.
+// @Tags firewall
+// @Accept  json
+// @Produce  json
+// @Param id query string true "Rule ID"
+// @Param rule body FirewallRule true "Updated firewall rule"
+// @Success 200 {object} FirewallRule
+// @Router /api/firewall [put]
+func handleUpdateFirewallRule(w http.ResponseWriter, r *http.Request) {
+	ruleID := r.URL.Query().Get("id")
+	if ruleID == "" {
+		http.Error(w, "id query parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	var rule FirewallRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Verify rule ownership via site ownership
+	var siteID string
+	var blocklistID sql.NullString
+	err := db.QueryRow("SELECT site_id, blocklist_id FROM firewall_rules WHERE id = $1", ruleID).Scan(&siteID, &blocklistID)
+	if err != nil {
+		http.Error(w, "Firewall rule not found", http.StatusNotFound)
+		return
+	}
+	if !canAccessSite(r, siteID, ScopeFirewallManage) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if blocklistID.Valid {
+		http.Error(w, "Rule is managed by a blocklist subscription", http.StatusConflict)
+		return
+	}
+
+	if err := validateFirewallRule(&rule); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, err = db.Exec("UPDATE firewall_rules SET rule_type = $1, value = $2, action = $3, priority = $4, expires_at = $5, note = $6 WHERE id = $7",
+		rule.RuleType, rule.Value, rule.Action, rule.Priority, rule.ExpiresAt, rule.Note, ruleID)
+	if err != nil {
+		http.Error(w, "Failed to update firewall rule", http.StatusInternalServerError)
+		return
+	}
+	firewallRules.invalidate(siteID)
+
+	updated, err := queryFirewallRules("r.id = $1", ruleID)
+	if err != nil || len(updated) == 0 {
+		http.Error(w, "Failed to fetch firewall rule", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(updated[0])
+}
+
 // @Summary Delete a firewall rule
 // @Description Delete an existing firewall rule.
 // @Tags firewall
@@ -150,7 +361,6 @@ func handleCreateFirewallRule(w http.ResponseWriter, r *http.Request) {
 // @Success 204 "No Content"
 // @Router /api/firewall [delete]
 func handleDeleteFirewallRule(w http.ResponseWriter, r *http.Request) {
-	userID := r.Context().Value("userID").(int)
 	ruleID := r.URL.Query().Get("id")
 	if ruleID == "" {
 		http.Error(w, "id query parameter is required", http.StatusBadRequest)
@@ -159,23 +369,27 @@ func handleDeleteFirewallRule(w http.ResponseWriter, r *http.Request) {
 
 	// Verify rule ownership via site ownership
 	var siteID string
-	var ownerID int
-	err := db.QueryRow("SELECT site_id FROM firewall_rules WHERE id = $1", ruleID).Scan(&siteID)
+	var blocklistID sql.NullString
+	err := db.QueryRow("SELECT site_id, blocklist_id FROM firewall_rules WHERE id = $1", ruleID).Scan(&siteID, &blocklistID)
 	if err != nil {
 		http.Error(w, "Firewall rule not found", http.StatusNotFound)
 		return
 	}
-	err = db.QueryRow("SELECT user_id FROM sites WHERE id = $1", siteID).Scan(&ownerID)
-	if err != nil || ownerID != userID {
+	if !canAccessSite(r, siteID, ScopeFirewallManage) {
 		http.Error(w, "Forbidden", http.StatusForbidden)
 		return
 	}
+	if blocklistID.Valid {
+		http.Error(w, "Rule is managed by a blocklist subscription", http.StatusConflict)
+		return
+	}
 
 	_, err = db.Exec("DELETE FROM firewall_rules WHERE id = $1", ruleID)
 	if err != nil {
 		http.Error(w, "Failed to delete firewall rule", http.StatusInternalServerError)
 		return
 	}
+	firewallRules.invalidate(siteID)
 
 	w.WriteHeader(http.StatusNoContent)
 }
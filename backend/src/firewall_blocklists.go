@@ -0,0 +1,541 @@
+package sentinel
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Blocklist subscription limits
+const (
+	defaultBlocklistRefresh = 60 // minutes
+	minBlocklistRefresh     = 5
+	maxBlocklistRefresh     = 7 * 24 * 60
+	maxBlocklistBytes       = 32 << 20
+	maxBlocklistEntries     = 200000
+	maxBlocklistNameLength  = 100
+	blocklistFetchTimeout   = 30 * time.Second
+)
+
+// Blocklist is a subscription to a list of IPs and CIDRs, one per line,
+// read from a URL or from a file in the configured blocklist directory.
+// Each sync replaces the subscription's managed rules with the list's
+// current entries.
+type Blocklist struct {
+	ID             string `json:"id"`
+	SiteID         string `json:"siteId"`
+	Name           string `json:"name"`
+	Source         string `json:"source"`          // http(s) URL, or a path relative to the blocklist directory
+	Action         string `json:"action"`          // action of the managed rules, "block" by default
+	Priority       int    `json:"priority"`        // priority of the managed rules
+	RefreshMinutes int    `json:"refresh_minutes"` // how often the list is fetched again
+	Enabled        bool   `json:"enabled"`         // disabled subscriptions keep no rules
+
+	// Read-only fields
+	CreatedBy    *int       `json:"created_by,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+	LastSyncedAt *time.Time `json:"last_synced_at,omitempty"`
+	LastError    string     `json:"last_error"`    // why the last sync failed; the previous rules stay in place
+	Entries      int        `json:"entries"`       // rules created by the last successful sync
+	InvalidLines int        `json:"invalid_lines"` // lines of the last successful sync that weren't an IP or CIDR
+}
+
+const blocklistColumns = `id, site_id, name, source, action, priority, refresh_minutes, enabled,
+	created_by, created_at, last_synced_at, last_error, entries, invalid_lines`
+
+func scanBlocklist(row interface{ Scan(...any) error }) (Blocklist, error) {
+	var bl Blocklist
+	var createdBy sql.NullInt64
+	var lastSyncedAt sql.NullTime
+	err := row.Scan(&bl.ID, &bl.SiteID, &bl.Name, &bl.Source, &bl.Action, &bl.Priority, &bl.RefreshMinutes, &bl.Enabled,
+		&createdBy, &bl.CreatedAt, &lastSyncedAt, &bl.LastError, &bl.Entries, &bl.InvalidLines)
+	if createdBy.Valid {
+		id := int(createdBy.Int64)
+		bl.CreatedBy = &id
+	}
+	if lastSyncedAt.Valid {
+		bl.LastSyncedAt = &lastSyncedAt.Time
+	}
+	return bl, err
+}
+
+func findBlocklist(id string) (Blocklist, error) {
+	return scanBlocklist(db.QueryRow("SELECT "+blocklistColumns+" FROM firewall_blocklists WHERE id = $1", id))
+}
+
+// validateBlocklist checks the subscription's settings, filling in defaults.
+func validateBlocklist(bl *Blocklist) error {
+	bl.Name = strings.TrimSpace(bl.Name)
+	if bl.Name == "" || len(bl.Name) > maxBlocklistNameLength {
+		return fmt.Errorf("Name must be 1-%d characters", maxBlocklistNameLength)
+	}
+	bl.Source = strings.TrimSpace(bl.Source)
+	if strings.HasPrefix(bl.Source, "http://") || strings.HasPrefix(bl.Source, "https://") {
+		if u, err := url.Parse(bl.Source); err != nil || u.Hostname() == "" {
+			return errors.New("Invalid blocklist URL")
+		}
+	} else {
+		if config.Blocklists.Dir == "" {
+			return errors.New("Source must be an http(s) URL; file sources are disabled on this server")
+		}
+		if !filepath.IsLocal(bl.Source) {
+			return errors.New("Source must be an http(s) URL or a file path relative to the blocklist directory")
+		}
+	}
+	if bl.Action == "" {
+		bl.Action = ActionBlock
+	}
+	if _, ok := actionRank[bl.Action]; !ok {
+		return errors.New("Invalid action. Must be 'block', 'allow', 'challenge', 'log_only', or 'tag'")
+	}
+	if bl.RefreshMinutes == 0 {
+		bl.RefreshMinutes = defaultBlocklistRefresh
+	}
+	if bl.RefreshMinutes < minBlocklistRefresh || bl.RefreshMinutes > maxBlocklistRefresh {
+		return fmt.Errorf("refresh_minutes must be between %d and %d", minBlocklistRefresh, maxBlocklistRefresh)
+	}
+	return nil
+}
+
+// blocklistClient fetches URL sources. Unless private networks are allowed,
+// it refuses to connect to loopback, private and link-local addresses so a
+// subscription can't be used to probe the server's network.
+var blocklistClient = &http.Client{
+	Timeout: blocklistFetchTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				if config.Blocklists.AllowPrivateNetworks {
+					return nil
+				}
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				ip := net.ParseIP(host)
+				if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+					return fmt.Errorf("blocklist source resolves to non-public address %s", host)
+				}
+				return nil
+			},
+		}).DialContext,
+	},
+}
+
+// openBlocklistSource opens a subscription's URL or file.
+func openBlocklistSource(ctx context.Context, source string) (io.ReadCloser, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		if config.Blocklists.Dir == "" || !filepath.IsLocal(source) {
+			return nil, errors.New("file sources are disabled")
+		}
+		return os.Open(filepath.Join(config.Blocklists.Dir, source))
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", source, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "Sentinel-Analytics blocklist sync")
+	resp, err := blocklistClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected response %s", resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// parseBlocklist reads IPs and CIDRs, one per line, returning them
+// de-duplicated and canonicalized together with the number of lines that
+// held something else.
+func parseBlocklist(r io.Reader) ([]string, int, error) {
+	lr := &io.LimitedReader{R: r, N: maxBlocklistBytes + 1}
+	seen := map[string]bool{}
+	entries := []string{}
+	invalid := 0
+	scanner := bufio.NewScanner(lr)
+	for scanner.Scan() {
+		field, ok := blocklistEntry(scanner.Text())
+		if !ok {
+			continue
+		}
+		value, ok := parseIPOrCIDR(field)
+		if !ok {
+			invalid++
+			continue
+		}
+		if !seen[value] {
+			seen[value] = true
+			entries = append(entries, value)
+		}
+		if len(entries) > maxBlocklistEntries {
+			return nil, 0, fmt.Errorf("list has more than %d entries", maxBlocklistEntries)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, err
+	}
+	if lr.N <= 0 {
+		return nil, 0, fmt.Errorf("list is larger than %d MB", maxBlocklistBytes>>20)
+	}
+	if len(entries) == 0 && invalid > 0 {
+		return nil, 0, errors.New("list has no valid IP or CIDR entries")
+	}
+	return entries, invalid, nil
+}
+
+// parseIPOrCIDR reports whether s is an IP address or CIDR block, returning
+// it in canonical form.
+func parseIPOrCIDR(s string) (string, bool) {
+	if ip := net.ParseIP(s); ip != nil {
+		return ip.String(), true
+	}
+	if _, ipnet, err := net.ParseCIDR(s); err == nil {
+		return ipnet.String(), true
+	}
+	return "", false
+}
+
+// syncBlocklist fetches a subscription and brings its managed rules in line
+// with the list. Rules for entries still on the list are kept, so their hit
+// counters survive. On failure the previous rules stay in place and the
+// error is recorded on the subscription.
+func syncBlocklist(ctx context.Context, bl Blocklist) error {
+	err := syncBlocklistRules(ctx, bl)
+	if err != nil {
+		if _, dbErr := db.Exec("UPDATE firewall_blocklists SET last_error = $1 WHERE id = $2", err.Error(), bl.ID); dbErr != nil {
+			log.Printf("Error recording sync failure of blocklist %s: %v", bl.ID, dbErr)
+		}
+	}
+	return err
+}
+
+func syncBlocklistRules(ctx context.Context, bl Blocklist) error {
+	entries := []string{} // a disabled subscription keeps no rules
+	invalid := 0
+	if bl.Enabled {
+		ctx, cancel := context.WithTimeout(ctx, blocklistFetchTimeout)
+		defer cancel()
+		body, err := openBlocklistSource(ctx, bl.Source)
+		if err != nil {
+			return err
+		}
+		entries, invalid, err = parseBlocklist(body)
+		body.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	note := "Blocklist: " + bl.Name
+	if _, err := tx.Exec("DELETE FROM firewall_rules WHERE blocklist_id = $1 AND NOT (value = ANY($2))", bl.ID, pq.Array(entries)); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE firewall_rules SET action = $2, priority = $3, note = $4
+		WHERE blocklist_id = $1 AND (action <> $2 OR priority <> $3 OR note <> $4)`, bl.ID, bl.Action, bl.Priority, note); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO firewall_rules (site_id, rule_type, value, action, priority, note, blocklist_id)
+		SELECT $1, $2, v, $3, $4, $5, $6 FROM unnest($7::text[]) AS v
+		WHERE NOT EXISTS (SELECT 1 FROM firewall_rules r WHERE r.blocklist_id = $6 AND r.value = v)`,
+		bl.SiteID, RuleIP, bl.Action, bl.Priority, note, bl.ID, pq.Array(entries)); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE firewall_blocklists SET last_synced_at = now(), last_error = '', entries = $2, invalid_lines = $3
+		WHERE id = $1`, bl.ID, len(entries), invalid); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	firewallRules.invalidate(bl.SiteID)
+	return nil
+}
+
+// syncDueBlocklists syncs every enabled subscription whose refresh interval
+// has passed. Claiming a subscription bumps last_attempt_at, so replicas
+// never sync the same one at once.
+func syncDueBlocklists() {
+	rows, err := db.Query(`UPDATE firewall_blocklists SET last_attempt_at = now()
+		WHERE id IN (
+			SELECT id FROM firewall_blocklists
+			WHERE enabled AND (last_attempt_at IS NULL OR last_attempt_at <= now() - refresh_minutes * interval '1 minute')
+			FOR UPDATE SKIP LOCKED)
+		RETURNING ` + blocklistColumns)
+	if err != nil {
+		log.Printf("Error claiming blocklists to sync: %v", err)
+		return
+	}
+	var due []Blocklist
+	for rows.Next() {
+		bl, err := scanBlocklist(rows)
+		if err != nil {
+			log.Printf("Error reading blocklist: %v", err)
+			continue
+		}
+		due = append(due, bl)
+	}
+	rows.Close()
+
+	for _, bl := range due {
+		if err := syncBlocklist(context.Background(), bl); err != nil {
+			log.Printf("Error syncing blocklist %s (%s): %v", bl.ID, bl.Name, err)
+		}
+	}
+}
+
+// startBlocklistSync refreshes blocklist subscriptions in the background.
+func startBlocklistSync() {
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		for {
+			syncDueBlocklists()
+			<-ticker.C
+		}
+	}()
+}
+
+// FirewallBlocklistsApiHandler routes requests to appropriate functions based on HTTP method.
+func FirewallBlocklistsApiHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		handleListBlocklists(w, r)
+	case "POST":
+		handleCreateBlocklist(w, r)
+	case "PUT":
+		handleUpdateBlocklist(w, r)
+	case "DELETE":
+		handleDeleteBlocklist(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// @Summary List blocklist subscriptions
+// @Description Get a site's blocklist subscriptions with the outcome of their last sync.
+// @Tags firewall
+// @Produce  json
+// @Param siteId query string true "Site ID"
+// @Success 200 {array} Blocklist
+// @Router /api/firewall/blocklists [get]
+func handleListBlocklists(w http.ResponseWriter, r *http.Request) {
+	siteID := r.URL.Query().Get("siteId")
+	if siteID == "" {
+		http.Error(w, "siteId query parameter is required", http.StatusBadRequest)
+		return
+	}
+	if !canAccessSite(r, siteID, ScopeFirewallManage) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	rows, err := db.Query("SELECT "+blocklistColumns+" FROM firewall_blocklists WHERE site_id = $1 ORDER BY priority, name", siteID)
+	if err != nil {
+		http.Error(w, "Failed to fetch blocklists", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	blocklists := []Blocklist{}
+	for rows.Next() {
+		bl, err := scanBlocklist(rows)
+		if err != nil {
+			http.Error(w, "Failed to fetch blocklists", http.StatusInternalServerError)
+			return
+		}
+		blocklists = append(blocklists, bl)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(blocklists)
+}
+
+// @Summary Subscribe to a blocklist
+// @Description Add a blocklist subscription and sync it right away. A failed first sync still creates the subscription, with last_error set.
+// @Tags firewall
+// @Accept  json
+// @Produce  json
+// @Param siteId query string true "Site ID"
+// @Param blocklist body Blocklist true "Blocklist subscription to create"
+// @Success 201 {object} Blocklist
+// @Router /api/firewall/blocklists [post]
+func handleCreateBlocklist(w http.ResponseWriter, r *http.Request) {
+	siteID := r.URL.Query().Get("siteId")
+	if siteID == "" {
+		http.Error(w, "siteId query parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	bl := Blocklist{Enabled: true}
+	if err := json.NewDecoder(r.Body).Decode(&bl); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if !canAccessSite(r, siteID, ScopeFirewallManage) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if err := validateBlocklist(&bl); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	userID := r.Context().Value("userID").(int)
+	var id string
+	err := db.QueryRow(`INSERT INTO firewall_blocklists (site_id, name, source, action, priority, refresh_minutes, enabled, created_by, last_attempt_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, now()) RETURNING id`,
+		siteID, bl.Name, bl.Source, bl.Action, bl.Priority, bl.RefreshMinutes, bl.Enabled, userID).Scan(&id)
+	if err != nil {
+		http.Error(w, "Failed to create blocklist", http.StatusInternalServerError)
+		return
+	}
+	respondWithSyncedBlocklist(w, r, id, http.StatusCreated)
+}
+
+// @Summary Update a blocklist subscription
+// @Description Change a subscription's settings and sync it again. Disabling a subscription removes its rules.
+// @Tags firewall
+// @Accept  json
+// @Produce  json
+// @Param id query string true "Blocklist ID"
+// @Param blocklist body Blocklist true "Updated blocklist subscription"
+// @Success 200 {object} Blocklist
+// @Router /api/firewall/blocklists [put]
+func handleUpdateBlocklist(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "id query parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	var bl Blocklist
+	if err := json.NewDecoder(r.Body).Decode(&bl); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	existing, err := findBlocklist(id)
+	if err != nil {
+		http.Error(w, "Blocklist not found", http.StatusNotFound)
+		return
+	}
+	if !canAccessSite(r, existing.SiteID, ScopeFirewallManage) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if err := validateBlocklist(&bl); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, err = db.Exec(`UPDATE firewall_blocklists SET name = $1, source = $2, action = $3, priority = $4, refresh_minutes = $5, enabled = $6, last_attempt_at = now()
+		WHERE id = $7`, bl.Name, bl.Source, bl.Action, bl.Priority, bl.RefreshMinutes, bl.Enabled, id)
+	if err != nil {
+		http.Error(w, "Failed to update blocklist", http.StatusInternalServerError)
+		return
+	}
+	respondWithSyncedBlocklist(w, r, id, http.StatusOK)
+}
+
+// @Summary Delete a blocklist subscription
+// @Description Delete a subscription together with its rules.
+// @Tags firewall
+// @Param id query string true "Blocklist ID"
+// @Success 204 "No Content"
+// @Router /api/firewall/blocklists [delete]
+func handleDeleteBlocklist(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "id query parameter is required", http.StatusBadRequest)
+		return
+	}
+	bl, err := findBlocklist(id)
+	if err != nil {
+		http.Error(w, "Blocklist not found", http.StatusNotFound)
+		return
+	}
+	if !canAccessSite(r, bl.SiteID, ScopeFirewallManage) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if _, err := db.Exec("DELETE FROM firewall_blocklists WHERE id = $1", id); err != nil {
+		http.Error(w, "Failed to delete blocklist", http.StatusInternalServerError)
+		return
+	}
+	firewallRules.invalidate(bl.SiteID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// @Summary Sync a blocklist now
+// @Description Fetch a subscription's list immediately instead of waiting for its refresh interval.
+// @Tags firewall
+// @Produce  json
+// @Param id query string true "Blocklist ID"
+// @Success 200 {object} Blocklist
+// @Router /api/firewall/blocklists/sync [post]
+func FirewallBlocklistSyncApiHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		http.Error(w, "id query parameter is required", http.StatusBadRequest)
+		return
+	}
+	bl, err := findBlocklist(id)
+	if err != nil {
+		http.Error(w, "Blocklist not found", http.StatusNotFound)
+		return
+	}
+	if !canAccessSite(r, bl.SiteID, ScopeFirewallManage) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if _, err := db.Exec("UPDATE firewall_blocklists SET last_attempt_at = now() WHERE id = $1", id); err != nil {
+		http.Error(w, "Failed to sync blocklist", http.StatusInternalServerError)
+		return
+	}
+	respondWithSyncedBlocklist(w, r, id, http.StatusOK)
+}
+
+// respondWithSyncedBlocklist syncs a subscription and writes its state. Sync
+// failures are reported through last_error rather than the status code.
+func respondWithSyncedBlocklist(w http.ResponseWriter, r *http.Request, id string, status int) {
+	bl, err := findBlocklist(id)
+	if err != nil {
+		http.Error(w, "Failed to fetch blocklist", http.StatusInternalServerError)
+		return
+	}
+	if err := syncBlocklist(r.Context(), bl); err != nil {
+		log.Printf("Error syncing blocklist %s (%s): %v", bl.ID, bl.Name, err)
+	}
+	if bl, err = findBlocklist(id); err != nil {
+		http.Error(w, "Failed to fetch blocklist", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(bl)
+}
@@ -0,0 +1,414 @@
+package sentinel
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// firewallChannel is the Postgres NOTIFY channel a trigger on firewall_rules
+// publishes changed site IDs on.
+const firewallChannel = "firewall_rules"
+
+// firewallCacheTTL is how long a compiled rule set is served before it is
+// reloaded; sweep drops rule sets older than this, so sites that stop
+// sending traffic don't stay cached forever.
+const firewallCacheTTL = 10 * time.Minute
+
+// errUnknownSite is returned when loading rules for a site that doesn't exist.
+var errUnknownSite = errors.New("unknown site")
+
+// compiledRule is a firewall rule plus its position in evaluation order.
+type compiledRule struct {
+	FirewallRule
+	rank int
+}
+
+// siteRuleSet is a site's firewall rules compiled for fast matching.
+type siteRuleSet struct {
+	ips           ipTrie
+	countries     map[string][]*compiledRule
+	asns          map[uint][]*compiledRule
+	asnOrgs       map[string][]*compiledRule // rules naming the AS organization
+	referrerHosts map[string][]*compiledRule
+	hostnames     map[string][]*compiledRule // exact hosts and "*.example.com" wildcards
+	userAgents    []patternRule
+	paths         []patternRule
+	trustBelow    []thresholdRule
+	nextExpiry    time.Time // when the earliest temporary rule expires; zero if none
+	loadedAt      time.Time
+}
+
+// thresholdRule is a trust_below rule with its parsed threshold.
+type thresholdRule struct {
+	rule  *compiledRule
+	below int
+}
+
+// patternRule is a user_agent or path rule with its compiled matcher.
+// user_agent rules without a regex match by case-insensitive substring.
+type patternRule struct {
+	rule   *compiledRule
+	re     *regexp.Regexp
+	substr string
+}
+
+func (p patternRule) match(s string) bool {
+	if p.re != nil {
+		return p.re.MatchString(s)
+	}
+	return strings.Contains(strings.ToLower(s), p.substr)
+}
+
+// firewallRequest holds the request attributes rules are matched against.
+type firewallRequest struct {
+	IP           net.IP
+	Country      string
+	ASN          uint
+	ASNOrg       string
+	UserAgent    string
+	Path         string // path of the tracked page
+	Hostname     string // host of the tracked page
+	ReferrerHost string
+	TrustScore   uint8
+}
+
+// firewallVerdict is the outcome of evaluating a request. Rule is nil when
+// no rule matched, in which case Action is empty. DryRun lists log_only
+// rules that matched ahead of the deciding rule.
+type firewallVerdict struct {
+	Action string
+	Rule   *FirewallRule
+	DryRun []*FirewallRule
+}
+
+// matched returns the deciding rule, if any, and the dry-run matches.
+func (v firewallVerdict) matched() []*FirewallRule {
+	if v.Rule == nil {
+		return v.DryRun
+	}
+	return append([]*FirewallRule{v.Rule}, v.DryRun...)
+}
+
+// firewallCache holds compiled rule sets by site ID. Existing sites without
+// rules are cached too, so traffic to them doesn't reach Postgres either;
+// unknown site IDs are never cached.
+type firewallCache struct {
+	mu    sync.RWMutex
+	sites map[string]*siteRuleSet
+	gen   uint64 // bumped on every invalidation so in-flight loads aren't cached stale
+	load  func(siteID string) ([]FirewallRule, error)
+}
+
+var firewallRules = &firewallCache{sites: map[string]*siteRuleSet{}, load: loadFirewallRules}
+
+// actionRank orders rules sharing a priority: allow wins over block, and
+// dry-run rules are looked at last.
+var actionRank = map[string]int{ActionAllow: 0, ActionBlock: 1, ActionChallenge: 2, ActionTag: 3, ActionLogOnly: 4}
+
+// compileRuleSet indexes rules by type. Rules are ranked by ascending
+// priority, then action, then the order they were loaded in.
+func compileRuleSet(rules []FirewallRule) *siteRuleSet {
+	sorted := make([]FirewallRule, len(rules))
+	copy(sorted, rules)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Priority != sorted[j].Priority {
+			return sorted[i].Priority < sorted[j].Priority
+		}
+		return actionRank[sorted[i].Action] < actionRank[sorted[j].Action]
+	})
+
+	rs := &siteRuleSet{
+		countries:     map[string][]*compiledRule{},
+		asns:          map[uint][]*compiledRule{},
+		asnOrgs:       map[string][]*compiledRule{},
+		referrerHosts: map[string][]*compiledRule{},
+		hostnames:     map[string][]*compiledRule{},
+	}
+	for i, rule := range sorted {
+		if rule.ExpiresAt != nil && (rs.nextExpiry.IsZero() || rule.ExpiresAt.Before(rs.nextExpiry)) {
+			rs.nextExpiry = *rule.ExpiresAt
+		}
+		cr := &compiledRule{FirewallRule: rule, rank: i}
+		switch rule.RuleType {
+		case RuleIP:
+			if !rs.ips.insert(strings.TrimSpace(rule.Value), cr) {
+				log.Printf("Skipping invalid firewall IP rule %s: %q", rule.ID, rule.Value)
+			}
+		case RuleCountry:
+			key := strings.ToUpper(strings.TrimSpace(rule.Value))
+			rs.countries[key] = append(rs.countries[key], cr)
+		case RuleASN:
+			if n, ok := parseASN(rule.Value); ok {
+				rs.asns[n] = append(rs.asns[n], cr)
+			} else {
+				key := strings.ToLower(strings.TrimSpace(rule.Value))
+				rs.asnOrgs[key] = append(rs.asnOrgs[key], cr)
+			}
+		case RuleUserAgent:
+			p, err := compileUserAgentPattern(rule.Value)
+			if err != nil {
+				log.Printf("Skipping invalid firewall user agent rule %s: %v", rule.ID, err)
+				continue
+			}
+			p.rule = cr
+			rs.userAgents = append(rs.userAgents, p)
+		case RulePath:
+			rs.paths = append(rs.paths, patternRule{rule: cr, re: regexp.MustCompile(globToRegex(rule.Value))})
+		case RuleReferrerHost:
+			key := normalizeHost(rule.Value)
+			rs.referrerHosts[key] = append(rs.referrerHosts[key], cr)
+		case RuleHostname:
+			key := strings.ToLower(strings.TrimSuffix(rule.Value, "."))
+			rs.hostnames[key] = append(rs.hostnames[key], cr)
+		case RuleTrustBelow:
+			below, err := strconv.Atoi(rule.Value)
+			if err != nil {
+				log.Printf("Skipping invalid firewall trust rule %s: %q", rule.ID, rule.Value)
+				continue
+			}
+			rs.trustBelow = append(rs.trustBelow, thresholdRule{rule: cr, below: below})
+		}
+	}
+	return rs
+}
+
+// compileUserAgentPattern treats a value wrapped in slashes, e.g.
+// "/(bot|spider)/", as a case-insensitive regular expression and anything
+// else as a case-insensitive substring.
+func compileUserAgentPattern(value string) (patternRule, error) {
+	if len(value) >= 2 && strings.HasPrefix(value, "/") && strings.HasSuffix(value, "/") {
+		re, err := regexp.Compile("(?i)" + value[1:len(value)-1])
+		if err != nil {
+			return patternRule{}, err
+		}
+		return patternRule{re: re}, nil
+	}
+	return patternRule{substr: strings.ToLower(value)}, nil
+}
+
+// matchHost appends rules keyed by host or, when wildcard is set, by
+// "*.parent" for each of its parent domains; otherwise rules keyed by a
+// parent domain match its subdomains too.
+func matchHost(rules map[string][]*compiledRule, host string, wildcard bool, dst []*compiledRule) []*compiledRule {
+	if host == "" {
+		return dst
+	}
+	dst = append(dst, rules[host]...)
+	labels := strings.Split(host, ".")
+	for i := 1; i < len(labels); i++ {
+		parent := strings.Join(labels[i:], ".")
+		if wildcard {
+			parent = "*." + parent
+		}
+		dst = append(dst, rules[parent]...)
+	}
+	return dst
+}
+
+// parseASN accepts "13335" or "AS13335".
+func parseASN(value string) (uint, bool) {
+	value = strings.TrimSpace(value)
+	if len(value) > 2 && strings.EqualFold(value[:2], "AS") {
+		value = value[2:]
+	}
+	n, err := strconv.ParseUint(value, 10, 32)
+	return uint(n), err == nil
+}
+
+// evaluate finds every rule matching req and walks them in rank order: the
+// first allow, block, challenge or tag rule decides, while log_only rules before it are
+// only reported.
+func (rs *siteRuleSet) evaluate(req firewallRequest) firewallVerdict {
+	var matched []*compiledRule
+	if req.IP != nil {
+		matched = rs.ips.lookup(req.IP, matched)
+	}
+	matched = append(matched, rs.countries[req.Country]...)
+	if req.ASN != 0 {
+		matched = append(matched, rs.asns[req.ASN]...)
+	}
+	if req.ASNOrg != "" {
+		matched = append(matched, rs.asnOrgs[strings.ToLower(req.ASNOrg)]...)
+	}
+	matched = matchHost(rs.referrerHosts, normalizeHost(req.ReferrerHost), false, matched)
+	matched = matchHost(rs.hostnames, strings.ToLower(req.Hostname), true, matched)
+	for _, p := range rs.userAgents {
+		if p.match(req.UserAgent) {
+			matched = append(matched, p.rule)
+		}
+	}
+	for _, p := range rs.paths {
+		if p.match(req.Path) {
+			matched = append(matched, p.rule)
+		}
+	}
+	for _, t := range rs.trustBelow {
+		if int(req.TrustScore) < t.below {
+			matched = append(matched, t.rule)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool { return matched[i].rank < matched[j].rank })
+
+	var v firewallVerdict
+	for _, cr := range matched {
+		rule := cr.FirewallRule
+		if rule.Action == ActionLogOnly {
+			v.DryRun = append(v.DryRun, &rule)
+			continue
+		}
+		v.Action = rule.Action
+		v.Rule = &rule
+		return v
+	}
+	return v
+}
+
+// get returns the site's compiled rules, loading them on a cache miss, once
+// one of the cached rules has expired or once the entry is older than
+// firewallCacheTTL.
+func (c *firewallCache) get(siteID string) (*siteRuleSet, error) {
+	now := time.Now()
+	c.mu.RLock()
+	rs, ok := c.sites[siteID]
+	gen := c.gen
+	c.mu.RUnlock()
+	if ok && now.Sub(rs.loadedAt) < firewallCacheTTL && (rs.nextExpiry.IsZero() || now.Before(rs.nextExpiry)) {
+		return rs, nil
+	}
+
+	rules, err := c.load(siteID)
+	if err != nil {
+		return nil, err
+	}
+	rs = compileRuleSet(rules)
+	rs.loadedAt = now
+	c.mu.Lock()
+	if c.gen == gen {
+		c.sites[siteID] = rs
+	}
+	c.mu.Unlock()
+	return rs, nil
+}
+
+func (c *firewallCache) invalidate(siteID string) {
+	c.mu.Lock()
+	delete(c.sites, siteID)
+	c.gen++
+	c.mu.Unlock()
+}
+
+// sweep drops rule sets that have outlived firewallCacheTTL.
+func (c *firewallCache) sweep(now time.Time) {
+	c.mu.Lock()
+	for siteID, rs := range c.sites {
+		if now.Sub(rs.loadedAt) >= firewallCacheTTL {
+			delete(c.sites, siteID)
+		}
+	}
+	c.mu.Unlock()
+}
+
+func (c *firewallCache) invalidateAll() {
+	c.mu.Lock()
+	c.sites = map[string]*siteRuleSet{}
+	c.gen++
+	c.mu.Unlock()
+}
+
+// loadFirewallRules returns the site's active rules, or errUnknownSite if
+// there is no such site.
+func loadFirewallRules(siteID string) ([]FirewallRule, error) {
+	if _, err := uuid.Parse(siteID); err != nil {
+		return nil, errUnknownSite
+	}
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM sites WHERE id = $1)", siteID).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errUnknownSite
+	}
+	rows, err := db.Query(`SELECT id, site_id, rule_type, value, action, priority, expires_at FROM firewall_rules
+		WHERE site_id = $1 AND (expires_at IS NULL OR expires_at > now()) ORDER BY created_at, id`, siteID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var rules []FirewallRule
+	for rows.Next() {
+		var rule FirewallRule
+		var expiresAt sql.NullTime
+		if err := rows.Scan(&rule.ID, &rule.SiteID, &rule.RuleType, &rule.Value, &rule.Action, &rule.Priority, &expiresAt); err != nil {
+			return nil, err
+		}
+		if expiresAt.Valid {
+			rule.ExpiresAt = &expiresAt.Time
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+// evaluateFirewall runs the site's firewall rules against a request. It
+// fails open, returning an empty verdict, if the rules cannot be loaded.
+func evaluateFirewall(siteID string, req firewallRequest) firewallVerdict {
+	rs, err := firewallRules.get(siteID)
+	if errors.Is(err, errUnknownSite) {
+		return firewallVerdict{}
+	}
+	if err != nil {
+		log.Printf("Error loading firewall rules: %v", err)
+		return firewallVerdict{}
+	}
+	return rs.evaluate(req)
+}
+
+// listenForFirewallChanges drops cached rule sets and reloads bans when any
+// replica changes a site's rules or bans. If the listener connection drops,
+// notifications may have been missed, so everything is reloaded when it
+// reconnects.
+func listenForFirewallChanges() {
+	listener := pq.NewListener(config.DatabaseURL, 10*time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		switch ev {
+		case pq.ListenerEventConnectionAttemptFailed, pq.ListenerEventDisconnected:
+			log.Printf("Firewall listener: %v", err)
+		}
+	})
+	for _, channel := range []string{firewallChannel, firewallBansChannel} {
+		if err := listener.Listen(channel); err != nil {
+			log.Printf("Error listening for %s changes: %v", channel, err)
+			return
+		}
+	}
+	go func() {
+		ping := time.NewTicker(90 * time.Second)
+		defer ping.Stop()
+		for {
+			select {
+			case n := <-listener.Notify:
+				switch {
+				case n == nil:
+					firewallRules.invalidateAll()
+					go trackLimiter.reloadBans("")
+				case n.Channel == firewallBansChannel:
+					go trackLimiter.reloadBans(n.Extra)
+				default:
+					firewallRules.invalidate(n.Extra)
+				}
+			case <-ping.C:
+				go listener.Ping()
+			}
+		}
+	}()
+}
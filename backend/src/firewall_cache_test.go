@@ -0,0 +1,60 @@
+package sentinel
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestFirewallCacheSkipsUnknownSites(t *testing.T) {
+	known := uuid.NewString()
+	c := &firewallCache{
+		sites: map[string]*siteRuleSet{},
+		load: func(siteID string) ([]FirewallRule, error) {
+			if siteID != known {
+				return nil, errUnknownSite
+			}
+			return nil, nil
+		},
+	}
+	for i := 0; i < 100; i++ {
+		if _, err := c.get(uuid.NewString()); err != errUnknownSite {
+			t.Fatalf("get(random) error = %v, want %v", err, errUnknownSite)
+		}
+	}
+	if len(c.sites) != 0 {
+		t.Errorf("cached %d unknown sites, want 0", len(c.sites))
+	}
+	if _, err := c.get(known); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.sites) != 1 {
+		t.Errorf("cached %d sites after loading a known one, want 1", len(c.sites))
+	}
+}
+
+func TestFirewallCacheSweep(t *testing.T) {
+	loads := 0
+	c := &firewallCache{
+		sites: map[string]*siteRuleSet{},
+		load: func(string) ([]FirewallRule, error) {
+			loads++
+			return nil, nil
+		},
+	}
+	c.get("a")
+	c.get("a")
+	if loads != 1 {
+		t.Fatalf("loaded %d times, want 1 while cached", loads)
+	}
+
+	c.sweep(time.Now())
+	if len(c.sites) != 1 {
+		t.Fatalf("sweep dropped a fresh rule set")
+	}
+	c.sweep(time.Now().Add(firewallCacheTTL))
+	if len(c.sites) != 0 {
+		t.Errorf("sweep kept %d stale rule sets, want 0", len(c.sites))
+	}
+}
@@ -0,0 +1,164 @@
+package sentinel
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	ruleHitFlushInterval = 10 * time.Second
+	ruleHitRetention     = 48 * time.Hour
+)
+
+type pendingRuleHits struct {
+	count   int64
+	lastHit time.Time
+}
+
+// ruleHitCounter buffers firewall rule hits in memory so the tracking path
+// never waits on Postgres; flush writes them out in one transaction.
+type ruleHitCounter struct {
+	mu   sync.Mutex
+	hits map[string]map[int64]*pendingRuleHits // rule ID -> hour (unix) -> hits
+}
+
+var ruleHits = &ruleHitCounter{hits: map[string]map[int64]*pendingRuleHits{}}
+
+// record counts one hit on each of the given rules.
+func (c *ruleHitCounter) record(now time.Time, rules ...*FirewallRule) {
+	hour := now.Truncate(time.Hour).Unix()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, rule := range rules {
+		byHour := c.hits[rule.ID]
+		if byHour == nil {
+			byHour = map[int64]*pendingRuleHits{}
+			c.hits[rule.ID] = byHour
+		}
+		p := byHour[hour]
+		if p == nil {
+			p = &pendingRuleHits{}
+			byHour[hour] = p
+		}
+		p.count++
+		p.lastHit = now
+	}
+}
+
+// flush writes buffered hits to firewall_rule_stats and firewall_rule_hits,
+// one transaction per rule. Hits on rules deleted in the meantime are
+// dropped. On any other error the unwritten hits go back into the buffer
+// for the next flush.
+func (c *ruleHitCounter) flush() {
+	c.mu.Lock()
+	pending := c.hits
+	c.hits = map[string]map[int64]*pendingRuleHits{}
+	c.mu.Unlock()
+
+	var failed error
+	for ruleID, byHour := range pending {
+		if failed != nil {
+			c.restore(ruleID, byHour)
+			continue
+		}
+		err := flushRuleHits(ruleID, byHour)
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23503" {
+			// The rule was deleted; its hits no longer matter.
+			continue
+		}
+		if err != nil {
+			// Postgres is most likely unavailable, so keep the rest for
+			// the next flush rather than trying every rule.
+			log.Printf("Error flushing firewall rule hits, will retry: %v", err)
+			failed = err
+			c.restore(ruleID, byHour)
+		}
+	}
+}
+
+func flushRuleHits(ruleID string, byHour map[int64]*pendingRuleHits) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var total int64
+	var lastHit time.Time
+	for hour, p := range byHour {
+		total += p.count
+		if p.lastHit.After(lastHit) {
+			lastHit = p.lastHit
+		}
+		_, err := tx.Exec(`INSERT INTO firewall_rule_hits (rule_id, hour, hits) VALUES ($1, $2, $3)
+			ON CONFLICT (rule_id, hour) DO UPDATE SET hits = firewall_rule_hits.hits + EXCLUDED.hits`,
+			ruleID, time.Unix(hour, 0).UTC(), p.count)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(`INSERT INTO firewall_rule_stats (rule_id, hits, last_hit_at) VALUES ($1, $2, $3)
+		ON CONFLICT (rule_id) DO UPDATE SET hits = firewall_rule_stats.hits + EXCLUDED.hits,
+			last_hit_at = GREATEST(firewall_rule_stats.last_hit_at, EXCLUDED.last_hit_at)`,
+		ruleID, total, lastHit.UTC())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// restore merges hits that could not be written back into the buffer.
+func (c *ruleHitCounter) restore(ruleID string, byHour map[int64]*pendingRuleHits) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	current := c.hits[ruleID]
+	if current == nil {
+		c.hits[ruleID] = byHour
+		return
+	}
+	for hour, p := range byHour {
+		cur := current[hour]
+		if cur == nil {
+			current[hour] = p
+			continue
+		}
+		cur.count += p.count
+		if p.lastHit.After(cur.lastHit) {
+			cur.lastHit = p.lastHit
+		}
+	}
+}
+
+// FlushFirewallHits writes out buffered rule hit counts; call it on shutdown.
+func FlushFirewallHits() {
+	ruleHits.flush()
+}
+
+// startFirewallMaintenance flushes hit counters, deletes expired rules,
+// prunes old hourly counts and evicts stale cached rule sets in the
+// background.
+func startFirewallMaintenance() {
+	go func() {
+		flush := time.NewTicker(ruleHitFlushInterval)
+		sweep := time.NewTicker(time.Minute)
+		for {
+			select {
+			case <-flush.C:
+				ruleHits.flush()
+			case now := <-sweep.C:
+				firewallRules.sweep(now)
+				// Deleting fires the change notification, so every replica
+				// drops the expired rules from its cache.
+				if _, err := db.Exec("DELETE FROM firewall_rules WHERE expires_at <= now()"); err != nil {
+					log.Printf("Error deleting expired firewall rules: %v", err)
+				}
+				if _, err := db.Exec("DELETE FROM firewall_rule_hits WHERE hour < $1", time.Now().Add(-ruleHitRetention)); err != nil {
+					log.Printf("Error pruning firewall rule hits: %v", err)
+				}
+			}
+		}
+	}()
+}
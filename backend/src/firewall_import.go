@@ -0,0 +1,397 @@
+package sentinel
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Bulk import limits
+const (
+	maxFirewallImportBytes = 10 << 20
+	maxFirewallImportRules = 50000
+)
+
+// Import and export formats
+const (
+	FormatCSV  = "csv"  // header row naming the rule_type, value, action, priority, expires_at and note columns
+	FormatText = "text" // one IP or CIDR per line; "#" and ";" start comments
+	FormatJSON = "json" // array of FirewallRule
+)
+
+// firewallCSVColumns are the columns written on export, in order.
+var firewallCSVColumns = []string{"rule_type", "value", "action", "priority", "expires_at", "note"}
+
+// FirewallImportLine reports what happened to one line of an import.
+type FirewallImportLine struct {
+	Line   int    `json:"line"` // 1-based line number, or array position for JSON
+	Value  string `json:"value"`
+	Status string `json:"status"` // "imported", "valid" (dry run), "duplicate" or "invalid"
+	Error  string `json:"error,omitempty"`
+	RuleID string `json:"rule_id,omitempty"`
+}
+
+// FirewallImportReport summarizes a bulk import.
+type FirewallImportReport struct {
+	DryRun     bool                 `json:"dry_run"`
+	Imported   int                  `json:"imported"`
+	Duplicates int                  `json:"duplicates"`
+	Invalid    int                  `json:"invalid"`
+	Lines      []FirewallImportLine `json:"lines"`
+}
+
+// importRow is a parsed rule, or the reason its line could not be parsed.
+type importRow struct {
+	line int
+	rule FirewallRule
+	err  error
+}
+
+// @Summary Import firewall rules
+// @Description Create many rules at once from CSV, a plain-text list of IPs and CIDRs, or JSON. Valid lines are imported and the report says what happened to every line; rules identical to an existing one are skipped.
+// @Tags firewall
+// @Accept  plain
+// @Produce  json
+// @Param siteId query string true "Site ID"
+// @Param format query string true "csv, text or json"
+// @Param action query string false "Action of rules imported from text (default block)"
+// @Param note query string false "Note on rules imported from text"
+// @Param dryRun query bool false "Only validate, don't create any rules"
+// @Success 200 {object} FirewallImportReport
+// @Router /api/firewall/import [post]
+func FirewallImportApiHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	siteID := q.Get("siteId")
+	if siteID == "" {
+		http.Error(w, "siteId query parameter is required", http.StatusBadRequest)
+		return
+	}
+	if !canAccessSite(r, siteID, ScopeFirewallManage) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	dryRun, _ := strconv.ParseBool(q.Get("dryRun"))
+
+	body := http.MaxBytesReader(w, r.Body, maxFirewallImportBytes)
+	var rows []importRow
+	var err error
+	switch q.Get("format") {
+	case FormatCSV:
+		rows, err = parseFirewallCSV(body)
+	case FormatText:
+		rows, err = parseFirewallText(body, q.Get("action"), q.Get("note"))
+	case FormatJSON:
+		rows, err = parseFirewallJSON(body)
+	default:
+		http.Error(w, "format must be 'csv', 'text', or 'json'", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("Import is larger than %d MB", maxFirewallImportBytes>>20), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(rows) > maxFirewallImportRules {
+		http.Error(w, fmt.Sprintf("Import has more than %d rules", maxFirewallImportRules), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	userID := r.Context().Value("userID").(int)
+	report, err := importFirewallRules(siteID, userID, rows, dryRun)
+	if err != nil {
+		log.Printf("Error importing firewall rules for site %s: %v", siteID, err)
+		http.Error(w, "Failed to import firewall rules", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// importFirewallRules validates rows and, unless dryRun is set, creates the
+// valid ones that don't duplicate an existing rule, all in one transaction.
+func importFirewallRules(siteID string, userID int, rows []importRow, dryRun bool) (FirewallImportReport, error) {
+	report := FirewallImportReport{DryRun: dryRun, Lines: make([]FirewallImportLine, 0, len(rows))}
+
+	existing, err := queryFirewallRules("r.site_id = $1 AND r.blocklist_id IS NULL", siteID)
+	if err != nil {
+		return report, err
+	}
+	key := func(rule FirewallRule) string { return rule.RuleType + "|" + rule.Value + "|" + rule.Action }
+	seen := make(map[string]bool, len(existing))
+	for _, rule := range existing {
+		seen[key(rule)] = true
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return report, err
+	}
+	defer tx.Rollback()
+	insert, err := tx.Prepare(`INSERT INTO firewall_rules (site_id, rule_type, value, action, priority, expires_at, note, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id`)
+	if err != nil {
+		return report, err
+	}
+	defer insert.Close()
+
+	for _, row := range rows {
+		line := FirewallImportLine{Line: row.line, Value: row.rule.Value}
+		err := row.err
+		if err == nil {
+			err = validateFirewallRule(&row.rule)
+			line.Value = row.rule.Value
+		}
+		switch {
+		case err != nil:
+			line.Status, line.Error = "invalid", err.Error()
+			report.Invalid++
+		case seen[key(row.rule)]:
+			line.Status = "duplicate"
+			report.Duplicates++
+		case dryRun:
+			line.Status = "valid"
+			seen[key(row.rule)] = true
+		default:
+			rule := row.rule
+			if err := insert.QueryRow(siteID, rule.RuleType, rule.Value, rule.Action, rule.Priority, rule.ExpiresAt, rule.Note, userID).Scan(&line.RuleID); err != nil {
+				return report, fmt.Errorf("line %d: %w", row.line, err)
+			}
+			line.Status = "imported"
+			seen[key(rule)] = true
+			report.Imported++
+		}
+		report.Lines = append(report.Lines, line)
+	}
+
+	if dryRun || report.Imported == 0 {
+		return report, nil
+	}
+	if err := tx.Commit(); err != nil {
+		return report, err
+	}
+	firewallRules.invalidate(siteID)
+	return report, nil
+}
+
+// parseFirewallText reads one IP or CIDR per line, as published by most
+// blocklists. Anything after "#" or ";" is a comment, and only the first
+// field of a line is used.
+func parseFirewallText(r io.Reader, action, note string) ([]importRow, error) {
+	var rows []importRow
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		value, ok := blocklistEntry(scanner.Text())
+		if !ok {
+			continue
+		}
+		rows = append(rows, importRow{line: n, rule: FirewallRule{RuleType: RuleIP, Value: value, Action: action, Note: note}})
+		if len(rows) > maxFirewallImportRules {
+			break
+		}
+	}
+	return rows, scanner.Err()
+}
+
+// blocklistEntry returns the first field of a blocklist line, or false for
+// blank and comment-only lines.
+func blocklistEntry(line string) (string, bool) {
+	if i := strings.IndexAny(line, "#;"); i >= 0 {
+		line = line[:i]
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", false
+	}
+	return fields[0], true
+}
+
+// parseFirewallCSV reads rules from CSV with a header row. rule_type and
+// value are required; the other columns of firewallCSVColumns are optional.
+func parseFirewallCSV(r io.Reader) ([]importRow, error) {
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+	cr.Comment = '#'
+	header, err := cr.Read()
+	if err != nil {
+		if err == io.EOF {
+			return nil, errors.New("CSV is empty")
+		}
+		return nil, fmt.Errorf("Invalid CSV header: %w", err)
+	}
+	col := map[string]int{}
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		known := false
+		for _, c := range firewallCSVColumns {
+			known = known || c == name
+		}
+		if !known {
+			return nil, fmt.Errorf("Unknown CSV column %q. Columns are %s", name, strings.Join(firewallCSVColumns, ", "))
+		}
+		col[name] = i
+	}
+	if _, ok := col["rule_type"]; !ok {
+		return nil, errors.New("CSV header must include rule_type and value columns")
+	}
+	if _, ok := col["value"]; !ok {
+		return nil, errors.New("CSV header must include rule_type and value columns")
+	}
+
+	var rows []importRow
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) && parseErr.Err == csv.ErrFieldCount {
+			rows = append(rows, importRow{line: parseErr.StartLine, err: errors.New("Wrong number of fields")})
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid CSV: %w", err)
+		}
+		line, _ := cr.FieldPos(0)
+		field := func(name string) string {
+			if i, ok := col[name]; ok {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		row := importRow{line: line, rule: FirewallRule{
+			RuleType: field("rule_type"),
+			Value:    field("value"),
+			Action:   field("action"),
+			Note:     field("note"),
+		}}
+		if v := field("priority"); v != "" {
+			if row.rule.Priority, err = strconv.Atoi(v); err != nil {
+				row.err = errors.New("priority must be a whole number")
+			}
+		}
+		if v := field("expires_at"); v != "" && row.err == nil {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				row.err = errors.New("expires_at must be an RFC 3339 timestamp")
+			}
+			row.rule.ExpiresAt = &t
+		}
+		rows = append(rows, row)
+		if len(rows) > maxFirewallImportRules {
+			break
+		}
+	}
+	return rows, nil
+}
+
+// parseFirewallJSON reads a JSON array of rules, in the shape the list and
+// export endpoints return. Read-only fields are ignored.
+func parseFirewallJSON(r io.Reader) ([]importRow, error) {
+	var rules []FirewallRule
+	if err := json.NewDecoder(r).Decode(&rules); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, err
+		}
+		return nil, errors.New("Invalid JSON: expected an array of firewall rules")
+	}
+	rows := make([]importRow, len(rules))
+	for i, rule := range rules {
+		rows[i] = importRow{line: i + 1, rule: FirewallRule{
+			RuleType:  rule.RuleType,
+			Value:     rule.Value,
+			Action:    rule.Action,
+			Priority:  rule.Priority,
+			ExpiresAt: rule.ExpiresAt,
+			Note:      rule.Note,
+		}}
+	}
+	return rows, nil
+}
+
+// @Summary Export firewall rules
+// @Description Download a site's rules as CSV, JSON, or a plain-text list of IPs and CIDRs. Rules managed by blocklist subscriptions are not exported.
+// @Tags firewall
+// @Produce  plain
+// @Param siteId query string true "Site ID"
+// @Param format query string true "csv, text or json"
+// @Param action query string false "For text, export IP rules with this action (default block)"
+// @Success 200 {string} string "Rules in the requested format"
+// @Router /api/firewall/export [get]
+func FirewallExportApiHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	siteID := q.Get("siteId")
+	if siteID == "" {
+		http.Error(w, "siteId query parameter is required", http.StatusBadRequest)
+		return
+	}
+	if !canAccessSite(r, siteID, ScopeFirewallManage) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	format := q.Get("format")
+	if format != FormatCSV && format != FormatText && format != FormatJSON {
+		http.Error(w, "format must be 'csv', 'text', or 'json'", http.StatusBadRequest)
+		return
+	}
+
+	rules, err := queryFirewallRules("r.site_id = $1 AND r.blocklist_id IS NULL", siteID)
+	if err != nil {
+		http.Error(w, "Failed to fetch firewall rules", http.StatusInternalServerError)
+		return
+	}
+
+	filename := "firewall-rules-" + siteID
+	switch format {
+	case FormatCSV:
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`.csv"`)
+		cw := csv.NewWriter(w)
+		cw.Write(firewallCSVColumns)
+		for _, rule := range rules {
+			var expiresAt string
+			if rule.ExpiresAt != nil {
+				expiresAt = rule.ExpiresAt.UTC().Format(time.RFC3339)
+			}
+			cw.Write([]string{rule.RuleType, rule.Value, rule.Action, strconv.Itoa(rule.Priority), expiresAt, rule.Note})
+		}
+		cw.Flush()
+	case FormatText:
+		action := q.Get("action")
+		if action == "" {
+			action = ActionBlock
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`.txt"`)
+		fmt.Fprintf(w, "# %s IP rules of site %s, exported %s\n", action, siteID, time.Now().UTC().Format(time.RFC3339))
+		for _, rule := range rules {
+			if rule.RuleType == RuleIP && rule.Action == action {
+				fmt.Fprintln(w, rule.Value)
+			}
+		}
+	case FormatJSON:
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`.json"`)
+		json.NewEncoder(w).Encode(rules)
+	}
+}
@@ -0,0 +1,330 @@
+package sentinel
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+// ActionRateLimit marks firewall log entries for hits rejected by an
+// automatic rate-limit ban.
+const ActionRateLimit = "rate_limit"
+
+const (
+	defaultFirewallLogLimit = 50
+	maxFirewallLogLimit     = 500
+)
+
+// FirewallEvent is one request stopped or flagged by the firewall.
+type FirewallEvent struct {
+	Timestamp time.Time `json:"timestamp"`
+	SiteID    string    `json:"siteId"`
+	ClientIP  string    `json:"ip"` // empty unless the site stores IPs
+	Country   string    `json:"country"`
+	ASN       uint32    `json:"asn"`
+	ASNOrg    string    `json:"asnOrg"`
+	UserAgent string    `json:"userAgent"`
+	URL       string    `json:"url"`
+	RuleID    string    `json:"ruleId"` // ban ID for rate_limit entries
+	RuleType  string    `json:"ruleType"`
+	Action    string    `json:"action"` // "block", "challenge", "rate_limit" or "log_only"
+}
+
+// FirewallRuleCount is the number of logged hits for one rule.
+type FirewallRuleCount struct {
+	RuleID   string `json:"ruleId"`
+	RuleType string `json:"ruleType"`
+	Action   string `json:"action"`
+	Count    uint64 `json:"count"`
+}
+
+// FirewallASNCount is the number of logged hits from one autonomous system.
+type FirewallASNCount struct {
+	ASN   uint32 `json:"asn"`
+	Org   string `json:"org"`
+	Count uint64 `json:"count"`
+}
+
+// FirewallLog is a page of firewall events plus aggregates over every event
+// matching the query.
+type FirewallLog struct {
+	Events    []FirewallEvent     `json:"events"`
+	Total     uint64              `json:"total"`
+	Page      int                 `json:"page"`
+	Limit     int                 `json:"limit"`
+	ByRule    []FirewallRuleCount `json:"byRule"`
+	ByCountry []CountStat         `json:"byCountry"`
+	ByASN     []FirewallASNCount  `json:"byAsn"`
+	Interval  string              `json:"interval"`
+	OverTime  []TimeseriesPoint   `json:"overTime"`
+}
+
+var firewallEventIngester = newIngester("firewall_events", `INSERT INTO firewall_events
+	(Timestamp, SiteID, ClientIP, Country, ASN, ASNOrg, UserAgent, URL, RuleID, RuleType, Action)`,
+	func(b driver.Batch, e FirewallEvent) error {
+		return b.Append(e.Timestamp, e.SiteID, e.ClientIP, e.Country, e.ASN, e.ASNOrg, e.UserAgent, e.URL, e.RuleID, e.RuleType, e.Action)
+	})
+
+// logFirewallEvent queues a firewall log entry. Entries are dropped rather
+// than slowing down tracking when the queue is full.
+func logFirewallEvent(siteID, ip, pageURL string, req firewallRequest, ruleID, ruleType, action string) {
+	firewallEventIngester.Enqueue(FirewallEvent{
+		Timestamp: time.Now().UTC(),
+		SiteID:    siteID,
+		ClientIP:  ip,
+		Country:   req.Country,
+		ASN:       uint32(req.ASN),
+		ASNOrg:    req.ASNOrg,
+		UserAgent: req.UserAgent,
+		URL:       pageURL,
+		RuleID:    ruleID,
+		RuleType:  ruleType,
+		Action:    action,
+	})
+}
+
+// firewallLogQuery selects firewall events of one site.
+type firewallLogQuery struct {
+	SiteID  string
+	Range   DateRange
+	IP      string
+	Country string
+	ASN     uint
+	RuleID  string
+	Action  string
+}
+
+func (q firewallLogQuery) where() (string, []any) {
+	clauses := []string{"SiteID = ?", "Timestamp >= ?", "Timestamp < ?"}
+	args := []any{q.SiteID, q.Range.From.UTC(), q.Range.To.UTC()}
+	add := func(clause string, arg any) {
+		clauses = append(clauses, clause)
+		args = append(args, arg)
+	}
+	if q.IP != "" {
+		add("ClientIP = ?", q.IP)
+	}
+	if q.Country != "" {
+		add("Country = ?", q.Country)
+	}
+	if q.ASN != 0 {
+		add("ASN = ?", q.ASN)
+	}
+	if q.RuleID != "" {
+		add("RuleID = ?", q.RuleID)
+	}
+	if q.Action != "" {
+		add("Action = ?", q.Action)
+	}
+	return strings.Join(clauses, " AND "), args
+}
+
+// @Summary Firewall log
+// @Description List requests blocked, rate limited or matched by dry-run rules, newest first, with counts by rule, country, ASN and over time.
+// @Tags firewall
+// @Produce  json
+// @Param siteId query string true "Site ID"
+// @Param from query string false "Start date (YYYY-MM-DD or RFC 3339)"
+// @Param to query string false "End date, inclusive (YYYY-MM-DD or RFC 3339)"
+// @Param page query int false "Page number, starting at 1"
+// @Param limit query int false "Events per page (default 50, max 500)"
+// @Param ip query string false "Only this client IP (sites that store IPs only)"
+// @Param country query string false "Only this country code"
+// @Param asn query string false "Only this ASN, e.g. AS13335"
+// @Param rule query string false "Only this rule or ban ID"
+// @Param action query string false "block, challenge, rate_limit or log_only"
+// @Param interval query string false "Bucket size of overTime: hour or day (default depends on the range)"
+// @Success 200 {object} FirewallLog
+// @Router /api/firewall/log [get]
+func FirewallLogApiHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	siteID := q.Get("siteId")
+	if siteID == "" {
+		http.Error(w, "siteId query parameter is required", http.StatusBadRequest)
+		return
+	}
+	if !canAccessSite(r, siteID, ScopeFirewallManage) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	dr, err := siteDateRange(r, siteID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	page, limit := 1, defaultFirewallLogLimit
+	if v := q.Get("page"); v != "" {
+		if page, err = strconv.Atoi(v); err != nil || page < 1 {
+			http.Error(w, "page must be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > maxFirewallLogLimit {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxFirewallLogLimit), http.StatusBadRequest)
+			return
+		}
+	}
+
+	lq := firewallLogQuery{
+		SiteID:  siteID,
+		Range:   dr,
+		IP:      q.Get("ip"),
+		Country: strings.ToUpper(q.Get("country")),
+		RuleID:  q.Get("rule"),
+		Action:  q.Get("action"),
+	}
+	if v := q.Get("asn"); v != "" {
+		asn, ok := parseASN(v)
+		if !ok {
+			http.Error(w, "Invalid ASN value", http.StatusBadRequest)
+			return
+		}
+		lq.ASN = asn
+	}
+	switch lq.Action {
+	case "", ActionBlock, ActionChallenge, ActionRateLimit, ActionLogOnly:
+	default:
+		http.Error(w, "action must be 'block', 'challenge', 'rate_limit', or 'log_only'", http.StatusBadRequest)
+		return
+	}
+
+	interval := q.Get("interval")
+	if interval == "" {
+		interval = "day"
+		if dr.To.Sub(dr.From) <= 48*time.Hour {
+			interval = "hour"
+		}
+	}
+	if interval != "hour" && interval != "day" {
+		http.Error(w, "interval must be 'hour' or 'day'", http.StatusBadRequest)
+		return
+	}
+	buckets, err := timeseriesBuckets(dr, interval)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := queryFirewallLog(context.Background(), lq, page, limit, interval, buckets)
+	if err != nil {
+		log.Printf("Error querying firewall log: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func queryFirewallLog(ctx context.Context, lq firewallLogQuery, page, limit int, interval string, buckets []time.Time) (FirewallLog, error) {
+	result := FirewallLog{
+		Events:    []FirewallEvent{},
+		Page:      page,
+		Limit:     limit,
+		ByRule:    []FirewallRuleCount{},
+		ByCountry: []CountStat{},
+		ByASN:     []FirewallASNCount{},
+		Interval:  interval,
+		OverTime:  []TimeseriesPoint{},
+	}
+	where, args := lq.where()
+
+	if err := chConn.QueryRow(ctx, "SELECT count() FROM firewall_events WHERE "+where, args...).Scan(&result.Total); err != nil {
+		return result, err
+	}
+
+	rows, err := chConn.Query(ctx, `
+		SELECT Timestamp, SiteID, ClientIP, Country, ASN, ASNOrg, UserAgent, URL, RuleID, RuleType, Action
+		FROM firewall_events WHERE `+where+`
+		ORDER BY Timestamp DESC
+		LIMIT ? OFFSET ?`, append(args, limit, (page-1)*limit)...)
+	if err != nil {
+		return result, err
+	}
+	for rows.Next() {
+		var e FirewallEvent
+		if err := rows.Scan(&e.Timestamp, &e.SiteID, &e.ClientIP, &e.Country, &e.ASN, &e.ASNOrg, &e.UserAgent, &e.URL, &e.RuleID, &e.RuleType, &e.Action); err != nil {
+			rows.Close()
+			return result, err
+		}
+		result.Events = append(result.Events, e)
+	}
+	rows.Close()
+
+	rows, err = chConn.Query(ctx, "SELECT RuleID, any(RuleType), any(Action), count() AS c FROM firewall_events WHERE "+where+" GROUP BY RuleID ORDER BY c DESC LIMIT 25", args...)
+	if err != nil {
+		return result, err
+	}
+	for rows.Next() {
+		var rc FirewallRuleCount
+		if err := rows.Scan(&rc.RuleID, &rc.RuleType, &rc.Action, &rc.Count); err != nil {
+			rows.Close()
+			return result, err
+		}
+		result.ByRule = append(result.ByRule, rc)
+	}
+	rows.Close()
+
+	rows, err = chConn.Query(ctx, "SELECT Country, count() AS c FROM firewall_events WHERE "+where+" GROUP BY Country ORDER BY c DESC LIMIT 25", args...)
+	if err != nil {
+		return result, err
+	}
+	for rows.Next() {
+		var cs CountStat
+		if err := rows.Scan(&cs.Value, &cs.Count); err != nil {
+			rows.Close()
+			return result, err
+		}
+		result.ByCountry = append(result.ByCountry, cs)
+	}
+	rows.Close()
+
+	rows, err = chConn.Query(ctx, "SELECT ASN, any(ASNOrg), count() AS c FROM firewall_events WHERE "+where+" GROUP BY ASN ORDER BY c DESC LIMIT 25", args...)
+	if err != nil {
+		return result, err
+	}
+	for rows.Next() {
+		var ac FirewallASNCount
+		if err := rows.Scan(&ac.ASN, &ac.Org, &ac.Count); err != nil {
+			rows.Close()
+			return result, err
+		}
+		result.ByASN = append(result.ByASN, ac)
+	}
+	rows.Close()
+
+	bucket, err := bucketExpr(interval, "Timestamp", lq.Range.Location)
+	if err != nil {
+		return result, err
+	}
+	rows, err = chConn.Query(ctx, "SELECT "+bucket+" AS bucket, count() FROM firewall_events WHERE "+where+" GROUP BY bucket ORDER BY bucket", args...)
+	if err != nil {
+		return result, err
+	}
+	defer rows.Close()
+	counts := map[int64]uint64{}
+	for rows.Next() {
+		var b time.Time
+		var c uint64
+		if err := rows.Scan(&b, &c); err != nil {
+			return result, err
+		}
+		counts[b.Unix()] = c
+	}
+	for _, b := range buckets {
+		result.OverTime = append(result.OverTime, TimeseriesPoint{Date: b, Value: float64(counts[b.Unix()])})
+	}
+	return result, rows.Err()
+}
@@ -0,0 +1,119 @@
+package sentinel
+
+import "testing"
+
+func TestValidateFirewallRule(t *testing.T) {
+	tests := []struct {
+		ruleType string
+		value    string
+		wantErr  bool
+		want     string // normalized value, if different from value
+	}{
+		{RuleUserAgent, "curl", false, ""},
+		{RuleUserAgent, "/(bot|spider)/", false, ""},
+		{RuleUserAgent, "/(bot/", true, ""},
+		{RuleUserAgent, "", true, ""},
+
+		{RuleReferrerHost, " Spam.Example ", false, "spam.example"},
+		{RuleReferrerHost, "https://spam.example/", true, ""},
+		{RuleReferrerHost, "", true, ""},
+
+		{RulePath, "/admin/*", false, ""},
+		{RulePath, "/p?ge", false, ""},
+		{RulePath, "admin", true, ""},
+
+		{RuleHostname, "Staging.Example.com", false, "staging.example.com"},
+		{RuleHostname, "*.example.com", false, ""},
+		{RuleHostname, "*", true, ""},
+		{RuleHostname, "staging..example.com", true, ""},
+
+		{RuleTrustBelow, "1", false, ""},
+		{RuleTrustBelow, " 100 ", false, "100"},
+		{RuleTrustBelow, "0", true, ""},
+		{RuleTrustBelow, "101", true, ""},
+		{RuleTrustBelow, "50.5", true, ""},
+	}
+	for _, tt := range tests {
+		rule := FirewallRule{RuleType: tt.ruleType, Value: tt.value}
+		err := validateFirewallRule(&rule)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("validate %s %q: err = %v, wantErr %v", tt.ruleType, tt.value, err, tt.wantErr)
+			continue
+		}
+		want := tt.want
+		if want == "" {
+			want = tt.value
+		}
+		if err == nil && rule.Value != want {
+			t.Errorf("validate %s %q: value = %q, want %q", tt.ruleType, tt.value, rule.Value, want)
+		}
+	}
+}
+
+func TestFirewallRuleMatching(t *testing.T) {
+	tests := []struct {
+		ruleType string
+		value    string
+		req      firewallRequest
+		match    bool
+	}{
+		{RuleUserAgent, "curl", firewallRequest{UserAgent: "Curl/8.0"}, true},
+		{RuleUserAgent, "curl", firewallRequest{UserAgent: "Mozilla/5.0"}, false},
+		{RuleUserAgent, "/(bot|spider)/", firewallRequest{UserAgent: "Googlebot/2.1"}, true},
+		{RuleUserAgent, "/^bot/", firewallRequest{UserAgent: "Googlebot/2.1"}, false},
+
+		{RuleReferrerHost, "spam.example", firewallRequest{ReferrerHost: "spam.example"}, true},
+		{RuleReferrerHost, "spam.example", firewallRequest{ReferrerHost: "www.spam.example"}, true},
+		{RuleReferrerHost, "spam.example", firewallRequest{ReferrerHost: "cdn.spam.example"}, true},
+		{RuleReferrerHost, "spam.example", firewallRequest{ReferrerHost: "notspam.example"}, false},
+		{RuleReferrerHost, "cdn.spam.example", firewallRequest{ReferrerHost: "spam.example"}, false},
+
+		{RulePath, "/admin/*", firewallRequest{Path: "/admin/users"}, true},
+		{RulePath, "/admin/*", firewallRequest{Path: "/administrator"}, false},
+		{RulePath, "/p?ge", firewallRequest{Path: "/page"}, true},
+		{RulePath, "/p?ge", firewallRequest{Path: "/pages"}, false},
+
+		{RuleHostname, "staging.example.com", firewallRequest{Hostname: "Staging.example.com"}, true},
+		{RuleHostname, "staging.example.com", firewallRequest{Hostname: "example.com"}, false},
+		{RuleHostname, "staging.example.com", firewallRequest{Hostname: "a.staging.example.com"}, false},
+		{RuleHostname, "*.example.com", firewallRequest{Hostname: "a.b.example.com"}, true},
+		{RuleHostname, "*.example.com", firewallRequest{Hostname: "example.com"}, false},
+
+		{RuleTrustBelow, "50", firewallRequest{TrustScore: 49}, true},
+		{RuleTrustBelow, "50", firewallRequest{TrustScore: 50}, false},
+		{RuleTrustBelow, "1", firewallRequest{TrustScore: 0}, true},
+		{RuleTrustBelow, "100", firewallRequest{TrustScore: 100}, false},
+	}
+	for _, tt := range tests {
+		rule := FirewallRule{ID: "r1", RuleType: tt.ruleType, Value: tt.value}
+		if err := validateFirewallRule(&rule); err != nil {
+			t.Fatalf("validate %s %q: %v", tt.ruleType, tt.value, err)
+		}
+		v := compileRuleSet([]FirewallRule{rule}).evaluate(tt.req)
+		if got := v.Rule != nil; got != tt.match {
+			t.Errorf("%s %q against %+v: matched = %v, want %v", tt.ruleType, tt.value, tt.req, got, tt.match)
+		}
+	}
+}
+
+func TestFirewallActionOrder(t *testing.T) {
+	rules := []FirewallRule{
+		{ID: "tag", RuleType: RuleCountry, Value: "NL", Action: ActionTag},
+		{ID: "challenge", RuleType: RuleCountry, Value: "NL", Action: ActionChallenge},
+		{ID: "dry", RuleType: RuleCountry, Value: "NL", Action: ActionLogOnly},
+	}
+	for i := range rules {
+		if err := validateFirewallRule(&rules[i]); err != nil {
+			t.Fatalf("validate %s: %v", rules[i].ID, err)
+		}
+	}
+	v := compileRuleSet(rules).evaluate(firewallRequest{Country: "NL"})
+	if v.Action != ActionChallenge || v.Rule.ID != "challenge" {
+		t.Errorf("verdict = %s by %v, want challenge", v.Action, v.Rule)
+	}
+
+	bad := FirewallRule{RuleType: RuleCountry, Value: "NL", Action: "captcha"}
+	if err := validateFirewallRule(&bad); err == nil {
+		t.Error("validate accepted unknown action captcha")
+	}
+}
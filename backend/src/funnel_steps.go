@@ -0,0 +1,148 @@
+package sentinel
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Funnel step types
+const (
+	StepPath       = "path"        // exact path, e.g. "/pricing"
+	StepPathPrefix = "path_prefix" // path prefix, e.g. "/blog/"
+	StepURLGlob    = "url_glob"    // glob on the full URL, "*" matches anything
+	StepURLRegex   = "url_regex"   // RE2 regular expression on the full URL
+	StepEvent      = "event"       // custom event name, optionally with property filters
+)
+
+const maxFunnelSteps = 20
+
+// FunnelStep is a single typed step of a funnel. Props is only valid for
+// event steps and requires every listed property to equal the given value.
+type FunnelStep struct {
+	Type  string            `json:"type"`
+	Value string            `json:"value"`
+	Props map[string]string `json:"props,omitempty"`
+}
+
+// UnmarshalJSON accepts legacy funnels whose steps were stored as bare path
+// strings in addition to the structured form.
+func (s *FunnelStep) UnmarshalJSON(data []byte) error {
+	var legacy string
+	if err := json.Unmarshal(data, &legacy); err == nil {
+		*s = FunnelStep{Type: StepPath, Value: legacy}
+		return nil
+	}
+	type plain FunnelStep
+	var step plain
+	if err := json.Unmarshal(data, &step); err != nil {
+		return err
+	}
+	*s = FunnelStep(step)
+	return nil
+}
+
+// Validate checks that the step is well-formed.
+func (s FunnelStep) Validate() error {
+	if strings.TrimSpace(s.Value) == "" {
+		return fmt.Errorf("step value cannot be empty")
+	}
+	if len(s.Props) > 0 && s.Type != StepEvent {
+		return fmt.Errorf("property filters are only supported on event steps")
+	}
+	switch s.Type {
+	case StepPath:
+		// Legacy steps may hold a full URL rather than a path.
+		if !strings.HasPrefix(s.Value, "/") && !strings.HasPrefix(s.Value, "http://") && !strings.HasPrefix(s.Value, "https://") {
+			return fmt.Errorf("path %q must start with '/' or be a full URL", s.Value)
+		}
+	case StepPathPrefix:
+		if !strings.HasPrefix(s.Value, "/") {
+			return fmt.Errorf("path %q must start with '/'", s.Value)
+		}
+	case StepURLGlob:
+		if _, err := regexp.Compile(globToRegex(s.Value)); err != nil {
+			return fmt.Errorf("invalid glob %q: %v", s.Value, err)
+		}
+	case StepURLRegex:
+		if _, err := regexp.Compile(s.Value); err != nil {
+			return fmt.Errorf("invalid regex %q: %v", s.Value, err)
+		}
+	case StepEvent:
+		if len(s.Value) > maxEventNameLen {
+			return fmt.Errorf("event name must be at most %d characters", maxEventNameLen)
+		}
+		for k := range s.Props {
+			if k == "" {
+				return fmt.Errorf("property filter names cannot be empty")
+			}
+		}
+	default:
+		return fmt.Errorf("invalid step type %q. Must be 'path', 'path_prefix', 'url_glob', 'url_regex', or 'event'", s.Type)
+	}
+	return nil
+}
+
+func validateFunnelSteps(steps []FunnelStep) error {
+	if len(steps) == 0 {
+		return fmt.Errorf("a funnel needs at least one step")
+	}
+	if len(steps) > maxFunnelSteps {
+		return fmt.Errorf("a funnel can have at most %d steps", maxFunnelSteps)
+	}
+	for i, step := range steps {
+		if err := step.Validate(); err != nil {
+			return fmt.Errorf("step %d: %v", i+1, err)
+		}
+	}
+	return nil
+}
+
+// globToRegex translates a URL glob where "*" matches any run of characters
+// and "?" a single character into an anchored RE2 pattern.
+func globToRegex(glob string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for _, part := range strings.SplitAfter(glob, "") {
+		switch part {
+		case "*":
+			b.WriteString(".*")
+		case "?":
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(part))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+// funnelStepCondition returns the ClickHouse boolean expression that matches
+// an event against a funnel step, together with its bind arguments.
+func funnelStepCondition(step FunnelStep) (string, []any) {
+	switch step.Type {
+	case StepPathPrefix:
+		return "(EventName = 'pageview' AND startsWith(path(URL), ?))", []any{step.Value}
+	case StepURLGlob:
+		return "(EventName = 'pageview' AND match(URL, ?))", []any{globToRegex(step.Value)}
+	case StepURLRegex:
+		return "(EventName = 'pageview' AND match(URL, ?))", []any{step.Value}
+	case StepEvent:
+		cond := "(EventName = ?"
+		args := []any{step.Value}
+		keys := make([]string, 0, len(step.Props))
+		for k := range step.Props {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			cond += " AND Props[?] = ?"
+			args = append(args, k, step.Props[k])
+		}
+		return cond + ")", args
+	default:
+		return "(EventName = 'pageview' AND (URL = ? OR path(URL) = ?))", []any{step.Value, step.Value}
+	}
+}
@@ -1,19 +1,57 @@
 package sentinel
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"log"
+	"math"
 	"net/http"
+	"strings"
+	"time"
 )
 
 type Funnel struct {
-	ID     string   `json:"id"`
-	SiteID string   `json:"siteId"`
-	Name   string   `json:"name"`
-	Steps  []string `json:"steps"`
+	ID     string       `json:"id"`
+	SiteID string       `json:"siteId"`
+	Name   string       `json:"name"`
+	Steps  []FunnelStep `json:"steps"`
+}
+
+// FunnelStepReport describes how many visitors reached a single funnel step.
+type FunnelStepReport struct {
+	Step                  FunnelStep `json:"step"`
+	Visitors              uint64     `json:"visitors"`
+	ConversionRate        float64    `json:"conversionRate"`        // relative to the previous step
+	OverallConversionRate float64    `json:"overallConversionRate"` // relative to the first step
+	DropOff               uint64     `json:"dropOff"`               // visitors lost since the previous step
+	DropOffRate           float64    `json:"dropOffRate"`
+	MedianTimeToConvert   float64    `json:"medianTimeToConvert"` // seconds since the previous step
+}
+
+// FunnelReport is the evaluated conversion report for a saved funnel.
+type FunnelReport struct {
+	FunnelID      string             `json:"funnelId"`
+	Name          string             `json:"name"`
+	From          time.Time          `json:"from"`
+	To            time.Time          `json:"to"`
+	WindowSeconds int                `json:"windowSeconds"` // most time allowed from first to last step; at most a day
+	Steps         []FunnelStepReport `json:"steps"`
 }
 
 // FunnelsApiHandler routes requests to appropriate functions based on HTTP method.
 func FunnelsApiHandler(w http.ResponseWriter, r *http.Request) {
+	// /api/funnels/{id}/report evaluates a funnel against ClickHouse events
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/funnels"), "/")
+	if strings.HasSuffix(path, "/report") {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		handleFunnelReport(w, r, strings.TrimSuffix(path, "/report"))
+		return
+	}
+
 	switch r.Method {
 	case "GET":
 		handleListFunnels(w, r)
@@ -29,7 +67,6 @@ func FunnelsApiHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func handleListFunnels(w http.ResponseWriter, r *http.Request) {
-	userID := r.Context().Value("userID").(int)
 	siteID := r.URL.Query().Get("siteId")
 	if siteID == "" {
 		http.Error(w, "siteId query parameter is required", http.StatusBadRequest)
@@ -37,9 +74,7 @@ func handleListFunnels(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Verify site ownership
-	var ownerID int
-	err := db.QueryRow("SELECT user_id FROM sites WHERE id = $1", siteID).Scan(&ownerID)
-	if err != nil || ownerID != userID {
+	if !canAccessSite(r, siteID, ScopeFunnelsManage) {
 		http.Error(w, "Forbidden", http.StatusForbidden)
 		return
 	}
@@ -70,7 +105,6 @@ func handleListFunnels(w http.ResponseWriter, r *http.Request) {
 }
 
 func handleCreateFunnel(w http.ResponseWriter, r *http.Request) {
-	userID := r.Context().Value("userID").(int)
 	var funnel Funnel
 	if err := json.NewDecoder(r.Body).Decode(&funnel); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
@@ -78,13 +112,16 @@ func handleCreateFunnel(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Verify site ownership
-	var ownerID int
-	err := db.QueryRow("SELECT user_id FROM sites WHERE id = $1", funnel.SiteID).Scan(&ownerID)
-	if err != nil || ownerID != userID {
+	if !canAccessSite(r, funnel.SiteID, ScopeFunnelsManage) {
 		http.Error(w, "Forbidden", http.StatusForbidden)
 		return
 	}
 
+	if err := validateFunnelSteps(funnel.Steps); err != nil {
+		http.Error(w, "Invalid funnel steps: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	stepsJSON, err := json.Marshal(funnel.Steps)
 	if err != nil {
 		http.Error(w, "Failed to serialize funnel steps", http.StatusInternalServerError)
@@ -105,7 +142,6 @@ func handleCreateFunnel(w http.ResponseWriter, r *http.Request) {
 }
 
 func handleUpdateFunnel(w http.ResponseWriter, r *http.Request) {
-	userID := r.Context().Value("userID").(int)
 	var funnel Funnel
 	if err := json.NewDecoder(r.Body).Decode(&funnel); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
@@ -113,13 +149,17 @@ func handleUpdateFunnel(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Verify funnel ownership via site ownership
-	var ownerID int
-	err := db.QueryRow("SELECT s.user_id FROM sites s JOIN funnels f ON s.id = f.site_id WHERE f.id = $1", funnel.ID).Scan(&ownerID)
-	if err != nil || ownerID != userID {
+	err := db.QueryRow("SELECT site_id FROM funnels WHERE id = $1", funnel.ID).Scan(&funnel.SiteID)
+	if err != nil || !canAccessSite(r, funnel.SiteID, ScopeFunnelsManage) {
 		http.Error(w, "Forbidden", http.StatusForbidden)
 		return
 	}
 
+	if err := validateFunnelSteps(funnel.Steps); err != nil {
+		http.Error(w, "Invalid funnel steps: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	stepsJSON, err := json.Marshal(funnel.Steps)
 	if err != nil {
 		http.Error(w, "Failed to serialize funnel steps", http.StatusInternalServerError)
@@ -138,7 +178,6 @@ func handleUpdateFunnel(w http.ResponseWriter, r *http.Request) {
 }
 
 func handleDeleteFunnel(w http.ResponseWriter, r *http.Request) {
-	userID := r.Context().Value("userID").(int)
 	funnelID := r.URL.Query().Get("id")
 	if funnelID == "" {
 		http.Error(w, "id query parameter is required", http.StatusBadRequest)
@@ -146,9 +185,9 @@ func handleDeleteFunnel(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Verify funnel ownership via site ownership
-	var ownerID int
-	err := db.QueryRow("SELECT s.user_id FROM sites s JOIN funnels f ON s.id = f.site_id WHERE f.id = $1", funnelID).Scan(&ownerID)
-	if err != nil || ownerID != userID {
+	var siteID string
+	err := db.QueryRow("SELECT site_id FROM funnels WHERE id = $1", funnelID).Scan(&siteID)
+	if err != nil || !canAccessSite(r, siteID, ScopeFunnelsManage) {
 		http.Error(w, "Forbidden", http.StatusForbidden)
 		return
 	}
@@ -161,3 +200,153 @@ func handleDeleteFunnel(w http.ResponseWriter, r *http.Request) {
 
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// @Summary Funnel conversion report
+// @Description Evaluate a funnel's steps against tracked pageviews and report per-step conversions. Visitor IDs rotate at UTC midnight, so a visitor must complete the steps within 24 hours and on one UTC day to count as converting.
+// @Tags funnels
+// @Produce  json
+// @Param id path string true "Funnel ID"
+// @Param from query string false "Start date (YYYY-MM-DD or RFC 3339)"
+// @Param to query string false "End date, inclusive (YYYY-MM-DD or RFC 3339)"
+// @Param tz query string false "IANA time zone (defaults to the site's time zone)"
+// @Param days query int false "Number of days to report on when from/to are not given (default 30)"
+// @Success 200 {object} FunnelReport
+// @Router /api/funnels/{id}/report [get]
+func handleFunnelReport(w http.ResponseWriter, r *http.Request, funnelID string) {
+	if funnelID == "" {
+		http.Error(w, "funnel id is required", http.StatusBadRequest)
+		return
+	}
+
+	// Verify funnel ownership via site ownership
+	var funnel Funnel
+	var stepsJSON []byte
+	err := db.QueryRow("SELECT id, site_id, name, steps FROM funnels WHERE id = $1", funnelID).
+		Scan(&funnel.ID, &funnel.SiteID, &funnel.Name, &stepsJSON)
+	if err != nil || !canAccessSite(r, funnel.SiteID, ScopeStatsRead) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if err := json.Unmarshal(stepsJSON, &funnel.Steps); err != nil {
+		http.Error(w, "Failed to parse funnel steps", http.StatusInternalServerError)
+		return
+	}
+
+	dr, err := siteDateRange(r, funnel.SiteID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	report, err := calculateFunnelReport(context.Background(), funnel, dr)
+	if err != nil {
+		log.Printf("Error calculating funnel report: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// funnelWindow is the windowFunnel window for a date range: the whole range,
+// capped at the lifetime of a visitor ID. A journey crossing UTC midnight
+// belongs to two visitor IDs, so a longer window could never match more.
+func funnelWindow(dr DateRange) time.Duration {
+	return min(dr.To.Sub(dr.From), visitorIDLifetime)
+}
+
+// calculateFunnelReport walks every visitor's ordered pageviews through the
+// funnel with windowFunnel and derives per-step counts and timings from it.
+// Steps only count when taken within funnelWindow of the first.
+func calculateFunnelReport(ctx context.Context, funnel Funnel, dr DateRange) (FunnelReport, error) {
+	windowSeconds := int(funnelWindow(dr) / time.Second)
+	report := FunnelReport{FunnelID: funnel.ID, Name: funnel.Name, From: dr.From, To: dr.To, WindowSeconds: windowSeconds, Steps: []FunnelStepReport{}}
+	if len(funnel.Steps) == 0 {
+		return report, nil
+	}
+
+	conds := make([]string, len(funnel.Steps))
+	var condArgs [][]any
+	for i, step := range funnel.Steps {
+		var args []any
+		conds[i], args = funnelStepCondition(step)
+		condArgs = append(condArgs, args)
+	}
+
+	// Bind arguments have to follow the order in which placeholders appear.
+	var args []any
+	inner := make([]string, 0, len(conds)+1)
+	inner = append(inner, fmt.Sprintf("windowFunnel(%d)(Timestamp, %s) AS level", windowSeconds, strings.Join(conds, ", ")))
+	for _, a := range condArgs {
+		args = append(args, a...)
+	}
+	for i, cond := range conds {
+		inner = append(inner, fmt.Sprintf("arraySort(groupArrayIf(Timestamp, %s)) AS s%d", cond, i+1))
+		args = append(args, condArgs[i]...)
+	}
+
+	// The time a visitor reached step N is the first hit on step N at or after step N-1.
+	middle := []string{"level", "arrayMin(s1) AS t1"}
+	for i := 2; i <= len(conds); i++ {
+		middle = append(middle, fmt.Sprintf("arrayFirst(x -> x >= t%d, s%d) AS t%d", i-1, i, i))
+	}
+
+	var outer []string
+	for i := 1; i <= len(conds); i++ {
+		outer = append(outer, fmt.Sprintf("countIf(level >= %d)", i))
+	}
+	for i := 2; i <= len(conds); i++ {
+		outer = append(outer, fmt.Sprintf("quantileIf(0.5)(toFloat64(date_diff('second', t%d, t%d)), level >= %d)", i-1, i, i))
+	}
+
+	query := fmt.Sprintf(`
+		SELECT %s
+		FROM (
+			SELECT %s
+			FROM (
+				SELECT VisitorID, %s
+				FROM events
+				WHERE SiteID = ? AND LCP IS NULL AND CLS IS NULL AND FID IS NULL AND Timestamp >= ? AND Timestamp < ? AND NOT Filtered
+				GROUP BY VisitorID
+			)
+		)`, strings.Join(outer, ", "), strings.Join(middle, ", "), strings.Join(inner, ", "))
+	args = append(args, funnel.SiteID, dr.From.UTC(), dr.To.UTC())
+
+	counts := make([]uint64, len(conds))
+	medians := make([]float64, len(conds)-1)
+	dest := make([]any, 0, len(counts)+len(medians))
+	for i := range counts {
+		dest = append(dest, &counts[i])
+	}
+	for i := range medians {
+		dest = append(dest, &medians[i])
+	}
+	if err := chConn.QueryRow(ctx, query, args...).Scan(dest...); err != nil {
+		return report, err
+	}
+
+	for i, step := range funnel.Steps {
+		stepReport := FunnelStepReport{Step: step, Visitors: counts[i]}
+		if counts[0] > 0 {
+			stepReport.OverallConversionRate = float64(counts[i]) / float64(counts[0]) * 100
+		}
+		if i == 0 {
+			if counts[0] > 0 {
+				stepReport.ConversionRate = 100
+			}
+		} else {
+			prev := counts[i-1]
+			stepReport.DropOff = prev - counts[i]
+			if prev > 0 {
+				stepReport.ConversionRate = float64(counts[i]) / float64(prev) * 100
+				stepReport.DropOffRate = float64(stepReport.DropOff) / float64(prev) * 100
+			}
+			if !math.IsNaN(medians[i-1]) {
+				stepReport.MedianTimeToConvert = medians[i-1]
+			}
+		}
+		report.Steps = append(report.Steps, stepReport)
+	}
+	return report, nil
+}
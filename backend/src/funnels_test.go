@@ -0,0 +1,55 @@
+package sentinel
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFunnelWindow(t *testing.T) {
+	from := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		length time.Duration
+		want   time.Duration
+	}{
+		{2 * time.Hour, 2 * time.Hour},
+		{24 * time.Hour, 24 * time.Hour},
+		{30 * 24 * time.Hour, 24 * time.Hour},
+		{5 * 366 * 24 * time.Hour, 24 * time.Hour},
+	}
+	for _, tt := range tests {
+		dr := DateRange{From: from, To: from.Add(tt.length), Location: time.UTC}
+		if got := funnelWindow(dr); got != tt.want {
+			t.Errorf("funnelWindow(%v range) = %v, want %v", tt.length, got, tt.want)
+		}
+	}
+}
+
+// A visitor who starts a funnel before UTC midnight and finishes after it is
+// hashed with two different daily salts, so the steps belong to two visitor
+// IDs and the funnel cannot count a conversion, even though the gap between
+// the steps is well inside the window.
+func TestFunnelStepsAcrossMidnight(t *testing.T) {
+	const site, ip, ua = "site", "203.0.113.7", "Mozilla/5.0"
+	saltByDay := map[string][]byte{
+		"2026-01-01": []byte("salt for the first day"),
+		"2026-01-02": []byte("salt for the second day"),
+	}
+	idAt := func(ts time.Time) uint64 {
+		return hashVisitor(saltByDay[ts.UTC().Format("2006-01-02")], site, ip, ua)
+	}
+
+	pricing := time.Date(2026, 1, 1, 23, 50, 0, 0, time.UTC)
+	checkout := time.Date(2026, 1, 2, 0, 10, 0, 0, time.UTC)
+	dr := DateRange{From: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), To: time.Date(2026, 1, 31, 0, 0, 0, 0, time.UTC), Location: time.UTC}
+	if checkout.Sub(pricing) > funnelWindow(dr) {
+		t.Fatalf("steps %v apart fall outside the %v window", checkout.Sub(pricing), funnelWindow(dr))
+	}
+	if idAt(pricing) == idAt(checkout) {
+		t.Errorf("steps on either side of midnight share visitor ID %d", idAt(pricing))
+	}
+
+	signup := time.Date(2026, 1, 1, 23, 55, 0, 0, time.UTC)
+	if idAt(pricing) != idAt(signup) {
+		t.Errorf("steps on the same day got different visitor IDs")
+	}
+}
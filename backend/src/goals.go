@@ -0,0 +1,294 @@
+package sentinel
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Goal is a conversion a site wants to count: a pageview matching a path or
+// a custom event. Goals reuse funnel step matching for their Type and Value.
+type Goal struct {
+	ID            string   `json:"id"`
+	SiteID        string   `json:"siteId"`
+	Name          string   `json:"name"`
+	Type          string   `json:"type"`  // "path", "path_prefix", "url_glob" or "event"
+	Value         string   `json:"value"` // path, glob or event name
+	MonetaryValue *float64 `json:"monetaryValue,omitempty"`
+}
+
+// GoalStats reports a goal's conversions for the dashboard period.
+type GoalStats struct {
+	GoalID         string  `json:"goalId"`
+	Name           string  `json:"name"`
+	Completions    uint64  `json:"completions"`
+	Converters     uint64  `json:"converters"`     // unique visitors who completed the goal
+	ConversionRate float64 `json:"conversionRate"` // converters as a percentage of unique visitors
+	Revenue        float64 `json:"revenue"`
+
+	// Percentage changes
+	CompletionsChange    float64 `json:"completionsChange"`
+	ConvertersChange     float64 `json:"convertersChange"`
+	ConversionRateChange float64 `json:"conversionRateChange"`
+	RevenueChange        float64 `json:"revenueChange"`
+}
+
+func (g Goal) step() FunnelStep {
+	return FunnelStep{Type: g.Type, Value: g.Value}
+}
+
+func (g Goal) validate() error {
+	if strings.TrimSpace(g.Name) == "" {
+		return fmt.Errorf("goal name cannot be empty")
+	}
+	switch g.Type {
+	case StepPath, StepPathPrefix, StepURLGlob, StepEvent:
+	default:
+		return fmt.Errorf("invalid goal type. Must be 'path', 'path_prefix', 'url_glob', or 'event'")
+	}
+	if g.MonetaryValue != nil && *g.MonetaryValue < 0 {
+		return fmt.Errorf("monetary value cannot be negative")
+	}
+	return g.step().Validate()
+}
+
+// GoalsApiHandler routes requests to appropriate functions based on HTTP method.
+func GoalsApiHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		handleListGoals(w, r)
+	case "POST":
+		handleCreateGoal(w, r)
+	case "PUT":
+		handleUpdateGoal(w, r)
+	case "DELETE":
+		handleDeleteGoal(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func loadGoals(siteID string) ([]Goal, error) {
+	rows, err := db.Query("SELECT id, site_id, name, goal_type, value, monetary_value FROM goals WHERE site_id = $1 ORDER BY name", siteID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	goals := []Goal{}
+	for rows.Next() {
+		var goal Goal
+		var monetary sql.NullFloat64
+		if err := rows.Scan(&goal.ID, &goal.SiteID, &goal.Name, &goal.Type, &goal.Value, &monetary); err != nil {
+			return nil, err
+		}
+		if monetary.Valid {
+			goal.MonetaryValue = &monetary.Float64
+		}
+		goals = append(goals, goal)
+	}
+	return goals, rows.Err()
+}
+
+// @Summary List goals
+// @Description Get all goals defined for a site.
+// @Tags goals
+// @Produce  json
+// @Param siteId query string true "Site ID"
+// @Success 200 {array} Goal
+// @Router /api/goals [get]
+func handleListGoals(w http.ResponseWriter, r *http.Request) {
+	siteID := r.URL.Query().Get("siteId")
+	if siteID == "" {
+		http.Error(w, "siteId query parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	// Verify site ownership
+	if !canAccessSite(r, siteID, ScopeStatsRead) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	goals, err := loadGoals(siteID)
+	if err != nil {
+		http.Error(w, "Failed to fetch goals", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(goals)
+}
+
+// @Summary Create a goal
+// @Description Add a pageview or custom event goal to a site.
+// @Tags goals
+// @Accept  json
+// @Produce  json
+// @Param goal body Goal true "Goal to create"
+// @Success 201 {object} Goal
+// @Router /api/goals [post]
+func handleCreateGoal(w http.ResponseWriter, r *http.Request) {
+	var goal Goal
+	if err := json.NewDecoder(r.Body).Decode(&goal); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Verify site ownership
+	if !canAccessSite(r, goal.SiteID, ScopeFunnelsManage) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if err := goal.validate(); err != nil {
+		http.Error(w, "Invalid goal: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err := db.QueryRow("INSERT INTO goals (site_id, name, goal_type, value, monetary_value) VALUES ($1, $2, $3, $4, $5) RETURNING id",
+		goal.SiteID, goal.Name, goal.Type, goal.Value, goal.MonetaryValue).Scan(&goal.ID)
+	if err != nil {
+		log.Printf("Error creating goal: %v", err)
+		http.Error(w, "Failed to create goal", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(goal)
+}
+
+// @Summary Update a goal
+// @Description Update an existing goal.
+// @Tags goals
+// @Accept  json
+// @Produce  json
+// @Param goal body Goal true "Goal to update"
+// @Success 200 {object} Goal
+// @Router /api/goals [put]
+func handleUpdateGoal(w http.ResponseWriter, r *http.Request) {
+	var goal Goal
+	if err := json.NewDecoder(r.Body).Decode(&goal); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Verify goal ownership via site ownership
+	err := db.QueryRow("SELECT site_id FROM goals WHERE id = $1", goal.ID).Scan(&goal.SiteID)
+	if err != nil || !canAccessSite(r, goal.SiteID, ScopeFunnelsManage) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if err := goal.validate(); err != nil {
+		http.Error(w, "Invalid goal: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, err = db.Exec("UPDATE goals SET name = $1, goal_type = $2, value = $3, monetary_value = $4 WHERE id = $5",
+		goal.Name, goal.Type, goal.Value, goal.MonetaryValue, goal.ID)
+	if err != nil {
+		http.Error(w, "Failed to update goal", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(goal)
+}
+
+// @Summary Delete a goal
+// @Description Delete an existing goal.
+// @Tags goals
+// @Param id query string true "Goal ID"
+// @Success 204 "No Content"
+// @Router /api/goals [delete]
+func handleDeleteGoal(w http.ResponseWriter, r *http.Request) {
+	goalID := r.URL.Query().Get("id")
+	if goalID == "" {
+		http.Error(w, "id query parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	// Verify goal ownership via site ownership
+	var siteID string
+	err := db.QueryRow("SELECT site_id FROM goals WHERE id = $1", goalID).Scan(&siteID)
+	if err != nil || !canAccessSite(r, siteID, ScopeFunnelsManage) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	if _, err := db.Exec("DELETE FROM goals WHERE id = $1", goalID); err != nil {
+		http.Error(w, "Failed to delete goal", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// queryGoalStats counts completions and converters for every goal in a single
+// pass over the query's events.
+func queryGoalStats(ctx context.Context, q StatsQuery, goals []Goal) ([]GoalStats, error) {
+	result := make([]GoalStats, len(goals))
+	if len(goals) == 0 {
+		return result, nil
+	}
+
+	columns := []string{"uniq(VisitorID)"}
+	var args []any
+	for _, goal := range goals {
+		cond, condArgs := funnelStepCondition(goal.step())
+		columns = append(columns, "countIf("+cond+")", "uniqIf(VisitorID, "+cond+")")
+		args = append(args, condArgs...)
+		args = append(args, condArgs...)
+	}
+	where, whereArgs := q.where()
+	query := "SELECT " + strings.Join(columns, ", ") + " FROM events WHERE " + where + " AND LCP IS NULL AND CLS IS NULL AND FID IS NULL"
+	args = append(args, whereArgs...)
+
+	var visitors uint64
+	dest := []any{&visitors}
+	for i := range result {
+		dest = append(dest, &result[i].Completions, &result[i].Converters)
+	}
+	if err := chConn.QueryRow(ctx, query, args...).Scan(dest...); err != nil {
+		return nil, err
+	}
+
+	for i, goal := range goals {
+		result[i].GoalID = goal.ID
+		result[i].Name = goal.Name
+		if visitors > 0 {
+			result[i].ConversionRate = float64(result[i].Converters) / float64(visitors) * 100
+		}
+		if goal.MonetaryValue != nil {
+			result[i].Revenue = float64(result[i].Completions) * *goal.MonetaryValue
+		}
+	}
+	return result, nil
+}
+
+// calculateGoalStats reports every goal of the site for the query period,
+// compared with the preceding period.
+func calculateGoalStats(ctx context.Context, q StatsQuery) ([]GoalStats, error) {
+	goals, err := loadGoals(q.SiteID)
+	if err != nil {
+		return nil, err
+	}
+	current, err := queryGoalStats(ctx, q, goals)
+	if err != nil {
+		return nil, err
+	}
+	previous, err := queryGoalStats(ctx, q.previous(), goals)
+	if err != nil {
+		return nil, err
+	}
+	for i := range current {
+		current[i].CompletionsChange = calculateChange(float64(current[i].Completions), float64(previous[i].Completions))
+		current[i].ConvertersChange = calculateChange(float64(current[i].Converters), float64(previous[i].Converters))
+		current[i].ConversionRateChange = calculateChange(current[i].ConversionRate, previous[i].ConversionRate)
+		current[i].RevenueChange = calculateChange(current[i].Revenue, previous[i].Revenue)
+	}
+	return current, nil
+}
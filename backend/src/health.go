@@ -0,0 +1,106 @@
+package sentinel
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// ingestSaturation is the queue fill ratio above which the service reports
+// itself as not ready.
+const ingestSaturation = 0.9
+
+var (
+	dbReady      atomic.Bool // set once Postgres migrations have run
+	chReady      atomic.Bool // set once ClickHouse migrations have run
+	shuttingDown atomic.Bool
+)
+
+// BeginShutdown makes /readyz fail so load balancers stop routing traffic
+// here while in-flight requests drain.
+func BeginShutdown() {
+	shuttingDown.Store(true)
+}
+
+// ReadinessReport is the body returned by /readyz.
+type ReadinessReport struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// HealthzHandler reports that the process is alive.
+func HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// ReadyzHandler reports whether the service can take traffic: both databases
+// reachable, GeoIP loaded and the ingestion queues not saturated.
+func ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+
+	report := ReadinessReport{Status: "ok", Checks: map[string]string{}}
+	check := func(name string, err error) {
+		if err != nil {
+			report.Status = "unavailable"
+			report.Checks[name] = err.Error()
+			return
+		}
+		report.Checks[name] = "ok"
+	}
+
+	if shuttingDown.Load() {
+		check("shutdown", errors.New("shutting down"))
+	}
+	check("postgres", checkPostgres(ctx))
+	check("clickhouse", checkClickHouse(ctx))
+	if geoipDb == nil {
+		check("geoip", errors.New("GeoIP country database not loaded"))
+	} else {
+		check("geoip", nil)
+	}
+	// The firewall log is best-effort: a flood of blocked requests can fill
+	// its queue, and that must not pull the replica out of rotation. Its
+	// state is still reported on /ingest/status.
+	check("ingestion", checkIngestion(eventIngester.Stats(), sessionIngester.Stats()))
+
+	w.Header().Set("Content-Type", "application/json")
+	if report.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+func checkPostgres(ctx context.Context) error {
+	if err := db.PingContext(ctx); err != nil {
+		return err
+	}
+	if !dbReady.Load() {
+		return errors.New("schema not initialized")
+	}
+	return nil
+}
+
+func checkClickHouse(ctx context.Context) error {
+	if err := chConn.Ping(ctx); err != nil {
+		return err
+	}
+	if !chReady.Load() {
+		return errors.New("schema not initialized")
+	}
+	return nil
+}
+
+func checkIngestion(stats ...IngestStats) error {
+	for _, st := range stats {
+		if float64(st.QueueDepth) >= ingestSaturation*float64(st.QueueCapacity) {
+			return fmt.Errorf("%s queue saturated (%d/%d)", st.Name, st.QueueDepth, st.QueueCapacity)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,464 @@
+package sentinel
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+// Ingestion tuning
+const (
+	ingestQueueSize     = 10000
+	ingestBatchSize     = 1000
+	ingestFlushInterval = 2 * time.Second
+	ingestWorkers       = 2
+	ingestMaxAttempts   = 5
+	ingestBaseBackoff   = 200 * time.Millisecond
+	ingestMaxBackoff    = 5 * time.Second
+	spoolReplayInterval = 5 * time.Second
+)
+
+// IngestStats reports the state of one ingestion queue.
+type IngestStats struct {
+	Name          string      `json:"name"`
+	QueueDepth    int         `json:"queueDepth"`
+	QueueCapacity int         `json:"queueCapacity"`
+	Enqueued      uint64      `json:"enqueued"`
+	Dropped       uint64      `json:"dropped"` // rejected because the queue was full or closed
+	Flushed       uint64      `json:"flushed"` // rows written to ClickHouse
+	Failed        uint64      `json:"failed"`  // rows lost after all retries and spooling
+	Batches       uint64      `json:"batches"`
+	Retries       uint64      `json:"retries"`
+	Spooled       uint64      `json:"spooled"`     // rows written to the on-disk spool
+	Replayed      uint64      `json:"replayed"`    // spooled rows later inserted
+	Quarantined   uint64      `json:"quarantined"` // rows ClickHouse rejected, set aside in the spool directory
+	Spool         *SpoolStats `json:"spool,omitempty"`
+}
+
+// Ingester buffers rows of type T in a bounded queue and writes them to
+// ClickHouse in batches from a small pool of workers. Batches that cannot be
+// inserted are written to an on-disk spool and replayed once ClickHouse is
+// reachable again.
+type Ingester[T any] struct {
+	name      string
+	insert    string
+	appendRow func(driver.Batch, T) error
+
+	queue  chan T
+	mu     sync.RWMutex // guards closed against concurrent Enqueue
+	closed bool
+	wg     sync.WaitGroup
+
+	spool      *spool
+	stopReplay chan struct{}
+	replayDone chan struct{}
+
+	enqueued, dropped, flushed, failed, batches, retries, spooled, replayed, quarantined atomic.Uint64
+}
+
+func newIngester[T any](name, insert string, appendRow func(driver.Batch, T) error) *Ingester[T] {
+	return &Ingester[T]{
+		name:      name,
+		insert:    insert,
+		appendRow: appendRow,
+		queue:     make(chan T, ingestQueueSize),
+	}
+}
+
+// Enqueue adds a row without blocking. It returns false if the queue is full
+// or the ingester is shutting down.
+func (in *Ingester[T]) Enqueue(row T) bool {
+	in.mu.RLock()
+	defer in.mu.RUnlock()
+	if in.closed {
+		in.dropped.Add(1)
+		return false
+	}
+	select {
+	case in.queue <- row:
+		in.enqueued.Add(1)
+		return true
+	default:
+		in.dropped.Add(1)
+		return false
+	}
+}
+
+func (in *Ingester[T]) start(sp *spool) {
+	in.spool = sp
+	for i := 0; i < ingestWorkers; i++ {
+		in.wg.Add(1)
+		go in.worker()
+	}
+	if sp != nil {
+		in.stopReplay = make(chan struct{})
+		in.replayDone = make(chan struct{})
+		go in.replayLoop()
+	}
+}
+
+// stop closes the queue and waits until every queued row has been flushed
+// or ctx expires.
+func (in *Ingester[T]) stop(ctx context.Context) error {
+	in.mu.Lock()
+	if !in.closed {
+		in.closed = true
+		close(in.queue)
+	}
+	in.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		in.wg.Wait()
+		if in.spool != nil {
+			close(in.stopReplay)
+			<-in.replayDone
+			in.spool.close()
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (in *Ingester[T]) worker() {
+	defer in.wg.Done()
+	ticker := time.NewTicker(ingestFlushInterval)
+	defer ticker.Stop()
+
+	buf := make([]T, 0, ingestBatchSize)
+	for {
+		select {
+		case row, ok := <-in.queue:
+			if !ok {
+				in.flush(buf)
+				return
+			}
+			buf = append(buf, row)
+			if len(buf) >= ingestBatchSize {
+				in.flush(buf)
+				buf = buf[:0]
+			}
+		case <-ticker.C:
+			if len(buf) > 0 {
+				in.flush(buf)
+				buf = buf[:0]
+			}
+		}
+	}
+}
+
+// flush writes rows as one batch, retrying with exponential backoff. While
+// earlier rows are still spooled, new rows go straight to the spool so they
+// are replayed in order behind them. A batch ClickHouse rejects outright is
+// quarantined rather than retried or spooled.
+func (in *Ingester[T]) flush(rows []T) {
+	if len(rows) == 0 {
+		return
+	}
+	if in.spool != nil && in.spool.pending() {
+		in.spoolRows(rows)
+		return
+	}
+	backoff := ingestBaseBackoff
+	var err error
+	for attempt := 1; attempt <= ingestMaxAttempts; attempt++ {
+		if err = in.send(rows); err == nil {
+			in.flushed.Add(uint64(len(rows)))
+			in.batches.Add(1)
+			return
+		}
+		if isPermanentInsertError(err) {
+			log.Printf("ClickHouse rejected %d %s rows, quarantining them: %v", len(rows), in.name, err)
+			in.quarantineRecords(in.encodeRows(rows))
+			return
+		}
+		if attempt == ingestMaxAttempts {
+			break
+		}
+		in.retries.Add(1)
+		log.Printf("Error flushing %d %s rows (attempt %d/%d), retrying in %v: %v", len(rows), in.name, attempt, ingestMaxAttempts, backoff, err)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, ingestMaxBackoff)
+	}
+	log.Printf("Error flushing %d %s rows after %d attempts: %v", len(rows), in.name, ingestMaxAttempts, err)
+	in.spoolRows(rows)
+}
+
+// spoolRows writes rows to the on-disk spool, dropping them if there is no
+// spool or it is full.
+func (in *Ingester[T]) spoolRows(rows []T) {
+	if in.spool == nil {
+		in.failed.Add(uint64(len(rows)))
+		log.Printf("Dropping %d %s rows: no spool configured", len(rows), in.name)
+		return
+	}
+	records := in.encodeRows(rows)
+	if err := in.spool.write(records); err != nil {
+		in.failed.Add(uint64(len(records)))
+		log.Printf("Dropping %d %s rows, could not spool them: %v", len(records), in.name, err)
+		return
+	}
+	in.spooled.Add(uint64(len(records)))
+}
+
+// encodeRows marshals rows to spool records, counting rows that cannot be
+// encoded as failed.
+func (in *Ingester[T]) encodeRows(rows []T) [][]byte {
+	records := make([][]byte, 0, len(rows))
+	for _, row := range rows {
+		rec, err := json.Marshal(row)
+		if err != nil {
+			in.failed.Add(1)
+			log.Printf("Error encoding %s row for spool: %v", in.name, err)
+			continue
+		}
+		records = append(records, rec)
+	}
+	return records
+}
+
+// quarantineRecords sets aside records that can never be inserted, dropping
+// them if there is no spool or the quarantine file is full.
+func (in *Ingester[T]) quarantineRecords(records [][]byte) {
+	if len(records) == 0 {
+		return
+	}
+	if in.spool == nil {
+		in.failed.Add(uint64(len(records)))
+		return
+	}
+	if err := in.spool.quarantine(records); err != nil {
+		in.failed.Add(uint64(len(records)))
+		log.Printf("Dropping %d rejected %s rows, could not quarantine them: %v", len(records), in.name, err)
+		return
+	}
+	in.quarantined.Add(uint64(len(records)))
+}
+
+func (in *Ingester[T]) replayLoop() {
+	defer close(in.replayDone)
+	ticker := time.NewTicker(spoolReplayInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-in.stopReplay:
+			return
+		case <-ticker.C:
+			if in.spool.pending() {
+				in.replaySpool()
+			}
+		}
+	}
+}
+
+// replaySpool inserts spooled rows in the order they were written, once
+// ClickHouse answers a ping. It stops at the first batch that fails with a
+// transient error and resumes from there on the next tick. Corrupt records
+// and batches ClickHouse rejects are quarantined so replay can move on.
+func (in *Ingester[T]) replaySpool() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	err := chConn.Ping(ctx)
+	cancel()
+	if err != nil {
+		return
+	}
+	err = in.spool.replay(ingestBatchSize, func(records [][]byte) error {
+		rows := make([]T, 0, len(records))
+		valid := make([][]byte, 0, len(records))
+		for _, rec := range records {
+			var row T
+			if err := json.Unmarshal(rec, &row); err != nil {
+				log.Printf("Quarantining corrupt %s spool record: %v", in.name, err)
+				in.quarantineRecords([][]byte{rec})
+				continue
+			}
+			rows = append(rows, row)
+			valid = append(valid, rec)
+		}
+		if len(rows) == 0 {
+			return nil
+		}
+		if err := in.send(rows); err != nil {
+			if !isPermanentInsertError(err) {
+				return err
+			}
+			log.Printf("ClickHouse rejected %d spooled %s rows, quarantining them: %v", len(rows), in.name, err)
+			in.quarantineRecords(valid)
+			return nil
+		}
+		in.replayed.Add(uint64(len(rows)))
+		in.batches.Add(1)
+		return nil
+	})
+	if err != nil {
+		log.Printf("Error replaying %s spool, will retry: %v", in.name, err)
+	}
+}
+
+func (in *Ingester[T]) send(rows []T) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	batch, err := chConn.PrepareBatch(ctx, in.insert)
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		if err := in.appendRow(batch, row); err != nil {
+			batch.Abort()
+			return rejectedRowError{err}
+		}
+	}
+	return batch.Send()
+}
+
+// rejectedRowError wraps a failure to convert a row to the batch's column
+// types, which no amount of retrying will fix.
+type rejectedRowError struct{ err error }
+
+func (e rejectedRowError) Error() string { return e.err.Error() }
+func (e rejectedRowError) Unwrap() error { return e.err }
+
+// permanentInsertCodes are ClickHouse error codes caused by the rows or the
+// schema rather than by the server's state.
+var permanentInsertCodes = map[int32]bool{
+	6:   true, // CANNOT_PARSE_TEXT
+	16:  true, // NO_SUCH_COLUMN_IN_TABLE
+	27:  true, // CANNOT_PARSE_INPUT_ASSERTION_FAILED
+	41:  true, // CANNOT_PARSE_DATETIME
+	53:  true, // TYPE_MISMATCH
+	70:  true, // CANNOT_CONVERT_TYPE
+	72:  true, // CANNOT_PARSE_NUMBER
+	117: true, // INCORRECT_DATA
+	321: true, // VALUE_IS_OUT_OF_RANGE_OF_DATA_TYPE
+}
+
+// isPermanentInsertError reports whether an insert failed because of the
+// rows themselves. Anything else, such as a dropped connection or an
+// overloaded server, is worth retrying.
+func isPermanentInsertError(err error) bool {
+	var rejected rejectedRowError
+	if errors.As(err, &rejected) {
+		return true
+	}
+	var ex *clickhouse.Exception
+	return errors.As(err, &ex) && permanentInsertCodes[ex.Code]
+}
+
+// Stats returns a snapshot of the ingester's counters.
+func (in *Ingester[T]) Stats() IngestStats {
+	st := IngestStats{
+		Name:          in.name,
+		QueueDepth:    len(in.queue),
+		QueueCapacity: cap(in.queue),
+		Enqueued:      in.enqueued.Load(),
+		Dropped:       in.dropped.Load(),
+		Flushed:       in.flushed.Load(),
+		Failed:        in.failed.Load(),
+		Batches:       in.batches.Load(),
+		Retries:       in.retries.Load(),
+		Spooled:       in.spooled.Load(),
+		Replayed:      in.replayed.Load(),
+		Quarantined:   in.quarantined.Load(),
+	}
+	if in.spool != nil {
+		sp := in.spool.stats()
+		st.Spool = &sp
+	}
+	return st
+}
+
+var eventIngester = newIngester("events", `INSERT INTO events
+	(Timestamp, SiteID, ClientIP, VisitorID, URL, Referrer, ScreenWidth, Browser, OS, Country, TrustScore, LCP, CLS, FID, EventName, Props,
+	 Source, Medium, UTMSource, UTMMedium, UTMCampaign, UTMTerm, UTMContent, RevenueAmount, RevenueCurrency, Filtered, FirewallRuleID)`,
+	func(b driver.Batch, e EventData) error {
+		return b.Append(
+			e.Timestamp, e.SiteID, e.ClientIP, e.VisitorID, e.URL, e.Referrer,
+			e.ScreenWidth, e.Browser, e.OS, e.Country, e.TrustScore,
+			e.LCP, e.CLS, e.FID, e.EventName, e.Props,
+			e.Source, e.Medium, e.UTMSource, e.UTMMedium, e.UTMCampaign, e.UTMTerm, e.UTMContent,
+			e.RevenueAmount, e.RevenueCurrency, e.Filtered, e.FirewallRuleID,
+		)
+	})
+
+var sessionIngester = newIngester("session_events", "INSERT INTO session_events (Timestamp, SiteID, SessionID, Payload)",
+	func(b driver.Batch, s SessionData) error {
+		return b.Append(s.Timestamp, s.SiteID, s.SessionID, string(s.Events))
+	})
+
+// StartIngestion starts the background batch writers and their spools. Call
+// it after InitClickHouse.
+func StartIngestion() {
+	dir, maxBytes := config.Spool.Dir, int64(config.Spool.MaxMB)<<20
+	for _, q := range ingestQueues() {
+		q.start(openIngestSpool(filepath.Join(dir, q.Stats().Name), maxBytes))
+	}
+}
+
+// ingestQueue is the type-independent part of an Ingester.
+type ingestQueue interface {
+	start(sp *spool)
+	stop(ctx context.Context) error
+	Stats() IngestStats
+}
+
+func ingestQueues() []ingestQueue {
+	return []ingestQueue{eventIngester, sessionIngester, firewallEventIngester}
+}
+
+func ingestStats() []IngestStats {
+	var stats []IngestStats
+	for _, q := range ingestQueues() {
+		stats = append(stats, q.Stats())
+	}
+	return stats
+}
+
+func openIngestSpool(dir string, maxBytes int64) *spool {
+	sp, err := openSpool(dir, maxBytes)
+	if err != nil {
+		log.Printf("Warning: could not open spool %s, failed inserts will be dropped: %v", dir, err)
+		return nil
+	}
+	return sp
+}
+
+// StopIngestion stops accepting rows and flushes everything still queued.
+func StopIngestion(ctx context.Context) error {
+	queues := ingestQueues()
+	errs := make([]error, len(queues))
+	var wg sync.WaitGroup
+	for i, q := range queues {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = q.stop(ctx)
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// IngestStatusHandler reports queue depth, drop and flush counters, and
+// spool usage for the ingestion queues.
+func IngestStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ingestStats())
+}
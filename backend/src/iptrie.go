@@ -0,0 +1,84 @@
+package sentinel
+
+import (
+	"net"
+	"net/netip"
+)
+
+// ipTrie is a binary radix tree of IPv4 and IPv6 prefixes mapped to the
+// firewall rules that name them. Lookups walk the address bit by bit, so
+// matching cost depends on the address length rather than on the number of
+// rules.
+type ipTrie struct {
+	v4, v6 *ipTrieNode
+}
+
+type ipTrieNode struct {
+	children [2]*ipTrieNode
+	rules    []*compiledRule // rules whose prefix ends here
+}
+
+// insert adds a single address or CIDR for rule. It reports false if value
+// is neither. IPv4-mapped IPv6 prefixes such as ::ffff:1.2.3.0/120 are stored
+// as their IPv4 equivalent, since lookups unmap addresses the same way.
+func (t *ipTrie) insert(value string, rule *compiledRule) bool {
+	var prefix netip.Prefix
+	if p, err := netip.ParsePrefix(value); err == nil {
+		prefix = p.Masked()
+	} else if addr, err := netip.ParseAddr(value); err == nil && addr.Zone() == "" {
+		prefix = netip.PrefixFrom(addr, addr.BitLen())
+	} else {
+		return false
+	}
+	if !prefix.IsValid() {
+		return false
+	}
+	if addr := prefix.Addr(); addr.Is4In6() {
+		prefix = netip.PrefixFrom(addr.Unmap(), prefix.Bits()-96)
+	}
+
+	root := &t.v6
+	var ip net.IP
+	if addr := prefix.Addr(); addr.Is4() {
+		a := addr.As4()
+		ip = a[:]
+		root = &t.v4
+	} else {
+		a := addr.As16()
+		ip = a[:]
+	}
+	if *root == nil {
+		*root = &ipTrieNode{}
+	}
+	node := *root
+	for i := 0; i < prefix.Bits(); i++ {
+		b := ipBit(ip, i)
+		if node.children[b] == nil {
+			node.children[b] = &ipTrieNode{}
+		}
+		node = node.children[b]
+	}
+	node.rules = append(node.rules, rule)
+	return true
+}
+
+// lookup appends the rules of every prefix containing ip to dst.
+func (t *ipTrie) lookup(ip net.IP, dst []*compiledRule) []*compiledRule {
+	node := t.v6
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		node = t.v4
+	}
+	for i := 0; node != nil; i++ {
+		dst = append(dst, node.rules...)
+		if i == len(ip)*8 {
+			break
+		}
+		node = node.children[ipBit(ip, i)]
+	}
+	return dst
+}
+
+func ipBit(ip net.IP, i int) int {
+	return int(ip[i/8]>>(7-uint(i%8))) & 1
+}
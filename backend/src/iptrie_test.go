@@ -0,0 +1,60 @@
+package sentinel
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIPTrieLookup(t *testing.T) {
+	tests := []struct {
+		value string
+		ip    string
+		match bool
+	}{
+		{"1.2.3.4", "1.2.3.4", true},
+		{"1.2.3.4", "1.2.3.5", false},
+		{"1.2.3.0/24", "1.2.3.200", true},
+		{"1.2.3.0/24", "1.2.4.1", false},
+		{"2001:db8::/32", "2001:db8::1", true},
+		{"2001:db8::/32", "2001:db9::1", false},
+		{"::ffff:1.2.3.0/120", "1.2.3.9", true},
+		{"::ffff:1.2.3.0/120", "1.2.4.9", false},
+		{"::ffff:1.2.3.4", "1.2.3.4", true},
+		{"::ffff:0:0/96", "8.8.8.8", true},
+		{"::ffff:0:0/96", "2001:db8::1", false},
+		{"1.2.3.0/24", "::ffff:1.2.3.7", true},
+	}
+	for _, tt := range tests {
+		var trie ipTrie
+		rule := &compiledRule{}
+		if !trie.insert(tt.value, rule) {
+			t.Errorf("insert(%q) = false", tt.value)
+			continue
+		}
+		got := len(trie.lookup(net.ParseIP(tt.ip), nil)) > 0
+		if got != tt.match {
+			t.Errorf("%q contains %s = %v, want %v", tt.value, tt.ip, got, tt.match)
+		}
+	}
+}
+
+func TestIPTrieInsertInvalid(t *testing.T) {
+	for _, value := range []string{"", "example.com", "1.2.3.4/33", "fe80::1%eth0"} {
+		var trie ipTrie
+		if trie.insert(value, &compiledRule{}) {
+			t.Errorf("insert(%q) = true, want false", value)
+		}
+	}
+}
+
+func TestCompileRuleSetMappedCIDR(t *testing.T) {
+	rule := FirewallRule{ID: "r1", RuleType: RuleIP, Value: "::ffff:1.2.3.0/120"}
+	if err := validateFirewallRule(&rule); err != nil {
+		t.Fatalf("validateFirewallRule: %v", err)
+	}
+	rs := compileRuleSet([]FirewallRule{rule})
+	v := rs.evaluate(firewallRequest{IP: net.ParseIP("1.2.3.4")})
+	if v.Rule == nil || v.Rule.ID != "r1" {
+		t.Errorf("evaluate matched %v, want rule r1", v.Rule)
+	}
+}
@@ -0,0 +1,386 @@
+package sentinel
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Migrations live in migrations/<store>/NNNN_name.up.sql with a matching
+// .down.sql. Applied versions for both stores are recorded in the Postgres
+// schema_migrations table, and runs are serialized with an advisory lock so
+// replicas starting together don't race.
+//
+//go:embed migrations/postgres/*.sql migrations/clickhouse/*.sql
+var migrationFiles embed.FS
+
+const (
+	storePostgres   = "postgres"
+	storeClickHouse = "clickhouse"
+
+	// migrationLockID is the pg_advisory_lock key held while migrating.
+	migrationLockID = 0x53454e54 // "SENT"
+)
+
+var migrationStores = []string{storePostgres, storeClickHouse}
+
+var migrationFileRe = regexp.MustCompile(`^(\d+)_([a-z0-9_]+)\.(up|down)\.sql$`)
+
+type migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationStatus describes one migration of a store.
+type MigrationStatus struct {
+	Store     string
+	Version   int
+	Name      string
+	AppliedAt *time.Time
+	Missing   bool // applied but no longer present in the binary
+}
+
+// loadMigrations returns the store's migrations ordered by version.
+func loadMigrations(store string) ([]migration, error) {
+	dir := path.Join("migrations", store)
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int]*migration{}
+	for _, e := range entries {
+		m := migrationFileRe.FindStringSubmatch(e.Name())
+		if m == nil {
+			return nil, fmt.Errorf("%s: unexpected migration file name %q", store, e.Name())
+		}
+		version, _ := strconv.Atoi(m[1])
+		body, err := fs.ReadFile(migrationFiles, path.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		mig := byVersion[version]
+		if mig == nil {
+			mig = &migration{Version: version, Name: m[2]}
+			byVersion[version] = mig
+		} else if mig.Name != m[2] {
+			return nil, fmt.Errorf("%s: migration %d has conflicting names %q and %q", store, version, mig.Name, m[2])
+		}
+		if m[3] == "up" {
+			mig.Up = string(body)
+		} else {
+			mig.Down = string(body)
+		}
+	}
+	migrations := make([]migration, 0, len(byVersion))
+	for _, mig := range byVersion {
+		if mig.Up == "" || mig.Down == "" {
+			return nil, fmt.Errorf("%s: migration %04d_%s needs both up and down files", store, mig.Version, mig.Name)
+		}
+		migrations = append(migrations, *mig)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// withMigrationLock runs fn on a dedicated connection holding the migration
+// advisory lock, creating the schema_migrations table if needed.
+func withMigrationLock(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockID); err != nil {
+		return fmt.Errorf("acquiring migration lock: %w", err)
+	}
+	defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLockID)
+
+	createMigrationsTable := `
+    CREATE TABLE IF NOT EXISTS schema_migrations (
+        store TEXT NOT NULL, -- "postgres" or "clickhouse"
+        version INTEGER NOT NULL,
+        name TEXT NOT NULL,
+        applied_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+        PRIMARY KEY (store, version)
+    );`
+	if _, err := conn.ExecContext(ctx, createMigrationsTable); err != nil {
+		return fmt.Errorf("creating schema_migrations table: %w", err)
+	}
+	return fn(conn)
+}
+
+func appliedMigrations(ctx context.Context, conn *sql.Conn, store string) (map[int]MigrationStatus, error) {
+	rows, err := conn.QueryContext(ctx, "SELECT version, name, applied_at FROM schema_migrations WHERE store = $1", store)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := map[int]MigrationStatus{}
+	for rows.Next() {
+		s := MigrationStatus{Store: store}
+		var at time.Time
+		if err := rows.Scan(&s.Version, &s.Name, &at); err != nil {
+			return nil, err
+		}
+		s.AppliedAt = &at
+		applied[s.Version] = s
+	}
+	return applied, rows.Err()
+}
+
+// migrateUp applies up to steps pending migrations of store (all if steps is
+// zero) and returns how many were applied.
+func migrateUp(ctx context.Context, store string, steps int) (int, error) {
+	migrations, err := loadMigrations(store)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	err = withMigrationLock(ctx, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn, store)
+		if err != nil {
+			return err
+		}
+		for _, m := range migrations {
+			if _, ok := applied[m.Version]; ok {
+				continue
+			}
+			if steps > 0 && count == steps {
+				break
+			}
+			if err := runMigration(ctx, conn, store, m, true); err != nil {
+				return fmt.Errorf("%s migration %04d_%s: %w", store, m.Version, m.Name, err)
+			}
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+// migrateDown rolls back the steps most recently applied migrations of store.
+func migrateDown(ctx context.Context, store string, steps int) (int, error) {
+	migrations, err := loadMigrations(store)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	err = withMigrationLock(ctx, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn, store)
+		if err != nil {
+			return err
+		}
+		for i := len(migrations) - 1; i >= 0 && count < steps; i-- {
+			m := migrations[i]
+			if _, ok := applied[m.Version]; !ok {
+				continue
+			}
+			if err := runMigration(ctx, conn, store, m, false); err != nil {
+				return fmt.Errorf("%s migration %04d_%s (down): %w", store, m.Version, m.Name, err)
+			}
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+// runMigration applies one migration in either direction and records it.
+// Postgres migrations run in a transaction together with the bookkeeping;
+// ClickHouse has no transactions, so its statements run one at a time and
+// should be written to be safely re-runnable.
+func runMigration(ctx context.Context, conn *sql.Conn, store string, m migration, up bool) error {
+	script := m.Down
+	record := "DELETE FROM schema_migrations WHERE store = $1 AND version = $2"
+	args := []any{store, m.Version}
+	if up {
+		script = m.Up
+		record = "INSERT INTO schema_migrations (store, version, name) VALUES ($1, $2, $3)"
+		args = append(args, m.Name)
+	}
+
+	switch store {
+	case storePostgres:
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if _, err := tx.ExecContext(ctx, script); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+			return err
+		}
+		return tx.Commit()
+	case storeClickHouse:
+		for _, stmt := range splitStatements(script) {
+			if err := chConn.Exec(ctx, stmt); err != nil {
+				return err
+			}
+		}
+		_, err := conn.ExecContext(ctx, record, args...)
+		return err
+	}
+	return fmt.Errorf("unknown store %q", store)
+}
+
+// splitStatements splits a script on semicolons ending a line, dropping
+// comment-only lines. Statements must not contain such semicolons inside
+// string literals.
+func splitStatements(script string) []string {
+	var stmts []string
+	var cur strings.Builder
+	for _, line := range strings.Split(script, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		cur.WriteString(line)
+		cur.WriteByte('\n')
+		if strings.HasSuffix(trimmed, ";") {
+			stmts = append(stmts, strings.TrimSuffix(strings.TrimSpace(cur.String()), ";"))
+			cur.Reset()
+		}
+	}
+	if rest := strings.TrimSpace(cur.String()); rest != "" {
+		stmts = append(stmts, rest)
+	}
+	return stmts
+}
+
+// migrationStatus lists every known and applied migration of store.
+func migrationStatus(ctx context.Context, store string) ([]MigrationStatus, error) {
+	migrations, err := loadMigrations(store)
+	if err != nil {
+		return nil, err
+	}
+	var statuses []MigrationStatus
+	err = withMigrationLock(ctx, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn, store)
+		if err != nil {
+			return err
+		}
+		for _, m := range migrations {
+			s := MigrationStatus{Store: store, Version: m.Version, Name: m.Name}
+			if a, ok := applied[m.Version]; ok {
+				s.AppliedAt = a.AppliedAt
+				delete(applied, m.Version)
+			}
+			statuses = append(statuses, s)
+		}
+		for _, a := range applied {
+			a.Missing = true
+			statuses = append(statuses, a)
+		}
+		return nil
+	})
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+	return statuses, err
+}
+
+// MigrateCommand implements `sentinel-backend migrate <status|up|down>`.
+func MigrateCommand(args []string) error {
+	usage := errors.New("usage: migrate <status|up|down> [-store postgres|clickhouse|all] [-steps N]")
+	if len(args) == 0 {
+		return usage
+	}
+	action := args[0]
+	if action != "status" && action != "up" && action != "down" {
+		return usage
+	}
+	flags := flag.NewFlagSet("migrate "+action, flag.ContinueOnError)
+	store := flags.String("store", "all", "store to migrate: postgres, clickhouse or all")
+	steps := flags.Int("steps", 0, "number of migrations to apply or roll back (up: 0 means all; down: default 1)")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	stores := migrationStores
+	if *store != "all" {
+		if *store != storePostgres && *store != storeClickHouse {
+			return fmt.Errorf("unknown store %q", *store)
+		}
+		stores = []string{*store}
+	}
+	if *steps < 0 {
+		return errors.New("-steps must not be negative")
+	}
+	if action == "down" && *store == "all" {
+		return errors.New("down requires -store postgres or -store clickhouse")
+	}
+
+	if err := openDatabase(); err != nil {
+		return err
+	}
+	ctx := context.Background()
+	if err := db.PingContext(ctx); err != nil {
+		return fmt.Errorf("connecting to Postgres: %w", err)
+	}
+	for _, s := range stores {
+		if s == storeClickHouse {
+			if err := openClickHouse(); err != nil {
+				return err
+			}
+			if err := pingClickHouse(ctx); err != nil {
+				return fmt.Errorf("connecting to ClickHouse: %w", err)
+			}
+		}
+	}
+
+	switch action {
+	case "status":
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "STORE\tVERSION\tNAME\tSTATUS")
+		for _, s := range stores {
+			statuses, err := migrationStatus(ctx, s)
+			if err != nil {
+				return err
+			}
+			for _, st := range statuses {
+				state := "pending"
+				if st.Missing {
+					state = "applied " + st.AppliedAt.Format(time.RFC3339) + " (missing from binary)"
+				} else if st.AppliedAt != nil {
+					state = "applied " + st.AppliedAt.Format(time.RFC3339)
+				}
+				fmt.Fprintf(w, "%s\t%04d\t%s\t%s\n", st.Store, st.Version, st.Name, state)
+			}
+		}
+		return w.Flush()
+	case "up":
+		for _, s := range stores {
+			n, err := migrateUp(ctx, s, *steps)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s: applied %d migration(s)\n", s, n)
+		}
+		return nil
+	case "down":
+		if *steps == 0 {
+			*steps = 1
+		}
+		n, err := migrateDown(ctx, *store, *steps)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s: rolled back %d migration(s)\n", *store, n)
+	}
+	return nil
+}
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS session_events;
+DROP TABLE IF EXISTS events;
@@ -0,0 +1,55 @@
+-- Baseline schema. Every statement is idempotent so servers initialized by
+-- the old init.sql converge on it without errors. Tables are unqualified and
+-- created in the configured database, which the backend creates first.
+
+CREATE TABLE IF NOT EXISTS events (
+    Timestamp DateTime,
+    SiteID String,
+    ClientIP String,
+    URL String,
+    Referrer String,
+    ScreenWidth UInt16,
+    Browser String,
+    OS String,
+    Country String,
+    TrustScore UInt8,
+    LCP Nullable(Float64),
+    CLS Nullable(Float64),
+    FID Nullable(Float64),
+    EventName LowCardinality(String) DEFAULT 'pageview',
+    Props Map(String, String),
+    VisitorID UInt64 DEFAULT cityHash64(SiteID, ClientIP),
+    Source LowCardinality(String),
+    Medium LowCardinality(String),
+    UTMSource String,
+    UTMMedium LowCardinality(String),
+    UTMCampaign String,
+    UTMTerm String,
+    UTMContent String,
+    RevenueAmount Nullable(Decimal(18, 4)),
+    RevenueCurrency LowCardinality(String)
+) ENGINE = MergeTree()
+ORDER BY (SiteID, Timestamp);
+
+ALTER TABLE events ADD COLUMN IF NOT EXISTS TrustScore UInt8;
+ALTER TABLE events ADD COLUMN IF NOT EXISTS EventName LowCardinality(String) DEFAULT 'pageview';
+ALTER TABLE events ADD COLUMN IF NOT EXISTS Props Map(String, String);
+-- Rows written before VisitorID existed fall back to a hash of the raw IP.
+ALTER TABLE events ADD COLUMN IF NOT EXISTS VisitorID UInt64 DEFAULT cityHash64(SiteID, ClientIP);
+ALTER TABLE events ADD COLUMN IF NOT EXISTS Source LowCardinality(String);
+ALTER TABLE events ADD COLUMN IF NOT EXISTS Medium LowCardinality(String);
+ALTER TABLE events ADD COLUMN IF NOT EXISTS UTMSource String;
+ALTER TABLE events ADD COLUMN IF NOT EXISTS UTMMedium LowCardinality(String);
+ALTER TABLE events ADD COLUMN IF NOT EXISTS UTMCampaign String;
+ALTER TABLE events ADD COLUMN IF NOT EXISTS UTMTerm String;
+ALTER TABLE events ADD COLUMN IF NOT EXISTS UTMContent String;
+ALTER TABLE events ADD COLUMN IF NOT EXISTS RevenueAmount Nullable(Decimal(18, 4));
+ALTER TABLE events ADD COLUMN IF NOT EXISTS RevenueCurrency LowCardinality(String);
+
+CREATE TABLE IF NOT EXISTS session_events (
+    Timestamp DateTime,
+    SiteID String,
+    SessionID String,
+    Payload String
+) ENGINE = MergeTree()
+ORDER BY (SiteID, SessionID, Timestamp);
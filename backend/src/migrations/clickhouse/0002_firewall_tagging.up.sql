@@ -0,0 +1,3 @@
+-- Hits matched by a "tag" firewall rule are stored but left out of stats.
+ALTER TABLE events ADD COLUMN IF NOT EXISTS Filtered Bool DEFAULT false;
+ALTER TABLE events ADD COLUMN IF NOT EXISTS FirewallRuleID String;
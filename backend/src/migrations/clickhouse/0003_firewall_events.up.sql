@@ -0,0 +1,16 @@
+-- Requests stopped or flagged by the firewall, kept for 90 days.
+CREATE TABLE IF NOT EXISTS firewall_events (
+    Timestamp DateTime,
+    SiteID String,
+    ClientIP String,
+    Country LowCardinality(String),
+    ASN UInt32,
+    ASNOrg String,
+    UserAgent String,
+    URL String,
+    RuleID String, -- firewall rule ID, or ban ID for rate limiting
+    RuleType LowCardinality(String),
+    Action LowCardinality(String) -- "block", "rate_limit" or "log_only"
+) ENGINE = MergeTree()
+ORDER BY (SiteID, Timestamp)
+TTL Timestamp + INTERVAL 90 DAY;
@@ -0,0 +1,9 @@
+DROP TABLE IF EXISTS api_keys;
+DROP TABLE IF EXISTS goals;
+DROP TABLE IF EXISTS exchange_rates;
+DROP TABLE IF EXISTS visitor_salts;
+DROP TABLE IF EXISTS sessions;
+DROP TABLE IF EXISTS funnels;
+DROP TABLE IF EXISTS firewall_rules;
+DROP TABLE IF EXISTS sites;
+DROP TABLE IF EXISTS users;
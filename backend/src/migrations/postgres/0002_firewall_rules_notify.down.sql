@@ -0,0 +1,2 @@
+DROP TRIGGER IF EXISTS firewall_rules_notify ON firewall_rules;
+DROP FUNCTION IF EXISTS notify_firewall_rules_changed();
@@ -0,0 +1,18 @@
+-- Tell every replica which site's firewall rules changed so it can drop its
+-- cached copy.
+CREATE OR REPLACE FUNCTION notify_firewall_rules_changed() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP <> 'INSERT' THEN
+        PERFORM pg_notify('firewall_rules', OLD.site_id::text);
+    END IF;
+    IF TG_OP <> 'DELETE' THEN
+        PERFORM pg_notify('firewall_rules', NEW.site_id::text);
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS firewall_rules_notify ON firewall_rules;
+CREATE TRIGGER firewall_rules_notify
+    AFTER INSERT OR UPDATE OR DELETE ON firewall_rules
+    FOR EACH ROW EXECUTE FUNCTION notify_firewall_rules_changed();
@@ -0,0 +1,2 @@
+ALTER TABLE firewall_rules DROP COLUMN IF EXISTS priority;
+ALTER TABLE firewall_rules DROP COLUMN IF EXISTS action;
@@ -0,0 +1,2 @@
+ALTER TABLE firewall_rules ADD COLUMN IF NOT EXISTS action TEXT NOT NULL DEFAULT 'block'; -- "block", "allow", "log_only" or "tag"
+ALTER TABLE firewall_rules ADD COLUMN IF NOT EXISTS priority INTEGER NOT NULL DEFAULT 0; -- lower runs first
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS firewall_bans;
+DROP FUNCTION IF EXISTS notify_firewall_bans_changed();
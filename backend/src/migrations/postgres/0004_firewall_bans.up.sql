@@ -0,0 +1,28 @@
+-- Automatic rate-limit bans. Rows are kept after they expire or are lifted
+-- as an audit trail.
+CREATE TABLE IF NOT EXISTS firewall_bans (
+    id UUID PRIMARY KEY,
+    site_id UUID NOT NULL REFERENCES sites(id) ON DELETE CASCADE,
+    ip TEXT NOT NULL,
+    reason TEXT NOT NULL,
+    hits INTEGER NOT NULL, -- hits counted in the window that triggered the ban
+    window_seconds INTEGER NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    lifted_at TIMESTAMP WITH TIME ZONE,
+    lifted_by INTEGER REFERENCES users(id) ON DELETE SET NULL
+);
+CREATE INDEX IF NOT EXISTS firewall_bans_site_id_idx ON firewall_bans(site_id, created_at DESC);
+
+-- Tell every replica which site's bans changed.
+CREATE OR REPLACE FUNCTION notify_firewall_bans_changed() RETURNS trigger AS $$
+BEGIN
+    PERFORM pg_notify('firewall_bans', NEW.site_id::text);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS firewall_bans_notify ON firewall_bans;
+CREATE TRIGGER firewall_bans_notify
+    AFTER INSERT OR UPDATE ON firewall_bans
+    FOR EACH ROW EXECUTE FUNCTION notify_firewall_bans_changed();
@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS firewall_rule_hits;
+DROP TABLE IF EXISTS firewall_rule_stats;
+ALTER TABLE firewall_rules DROP COLUMN IF EXISTS created_by;
+ALTER TABLE firewall_rules DROP COLUMN IF EXISTS note;
+ALTER TABLE firewall_rules DROP COLUMN IF EXISTS expires_at;
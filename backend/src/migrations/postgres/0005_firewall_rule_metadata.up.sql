@@ -0,0 +1,19 @@
+ALTER TABLE firewall_rules ADD COLUMN IF NOT EXISTS expires_at TIMESTAMP WITH TIME ZONE; -- NULL means permanent
+ALTER TABLE firewall_rules ADD COLUMN IF NOT EXISTS note TEXT NOT NULL DEFAULT '';
+ALTER TABLE firewall_rules ADD COLUMN IF NOT EXISTS created_by INTEGER REFERENCES users(id) ON DELETE SET NULL;
+
+-- Hit counters live outside firewall_rules so updating them doesn't fire the
+-- change notification that makes replicas reload their rules.
+CREATE TABLE IF NOT EXISTS firewall_rule_stats (
+    rule_id UUID PRIMARY KEY REFERENCES firewall_rules(id) ON DELETE CASCADE,
+    hits BIGINT NOT NULL DEFAULT 0,
+    last_hit_at TIMESTAMP WITH TIME ZONE
+);
+
+-- Hourly hit counts backing the last-24h figure; pruned after two days.
+CREATE TABLE IF NOT EXISTS firewall_rule_hits (
+    rule_id UUID NOT NULL REFERENCES firewall_rules(id) ON DELETE CASCADE,
+    hour TIMESTAMP WITH TIME ZONE NOT NULL,
+    hits BIGINT NOT NULL,
+    PRIMARY KEY (rule_id, hour)
+);
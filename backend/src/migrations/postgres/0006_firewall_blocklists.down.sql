@@ -0,0 +1,3 @@
+DELETE FROM firewall_rules WHERE blocklist_id IS NOT NULL;
+ALTER TABLE firewall_rules DROP COLUMN IF EXISTS blocklist_id;
+DROP TABLE IF EXISTS firewall_blocklists;
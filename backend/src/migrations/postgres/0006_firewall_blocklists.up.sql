@@ -0,0 +1,24 @@
+-- Blocklist subscriptions: IP/CIDR lists fetched from a file or URL and
+-- synced into firewall_rules as a group of managed rules.
+CREATE TABLE IF NOT EXISTS firewall_blocklists (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    site_id UUID NOT NULL REFERENCES sites(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    source TEXT NOT NULL, -- http(s) URL, or a file path under the configured blocklist directory
+    action TEXT NOT NULL DEFAULT 'block',
+    priority INTEGER NOT NULL DEFAULT 0,
+    refresh_minutes INTEGER NOT NULL DEFAULT 60,
+    enabled BOOLEAN NOT NULL DEFAULT TRUE,
+    created_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_attempt_at TIMESTAMP WITH TIME ZONE, -- claimed for a sync, successful or not
+    last_synced_at TIMESTAMP WITH TIME ZONE,
+    last_error TEXT NOT NULL DEFAULT '',
+    entries INTEGER NOT NULL DEFAULT 0, -- rules created by the last successful sync
+    invalid_lines INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS firewall_blocklists_site_id_idx ON firewall_blocklists(site_id);
+
+-- Rules owned by a blocklist are replaced on every sync and removed with it.
+ALTER TABLE firewall_rules ADD COLUMN IF NOT EXISTS blocklist_id UUID REFERENCES firewall_blocklists(id) ON DELETE CASCADE;
+CREATE INDEX IF NOT EXISTS firewall_rules_blocklist_id_idx ON firewall_rules(blocklist_id) WHERE blocklist_id IS NOT NULL;
@@ -0,0 +1,449 @@
+package sentinel
+
+import (
+	"database/sql"
+	"encoding/json"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// firewallBansChannel is the Postgres NOTIFY channel a trigger on
+// firewall_bans publishes changed site IDs on.
+const firewallBansChannel = "firewall_bans"
+
+const (
+	rateLimitShards = 32
+	// maxRecentBans bounds the in-memory history of ended bans kept when
+	// bans are not persisted.
+	maxRecentBans = 1000
+)
+
+// Ban is a temporary block of one IP on one site, created automatically when
+// the IP exceeds the /track rate limit. Ended bans are kept as an audit trail.
+type Ban struct {
+	ID            string     `json:"id"`
+	SiteID        string     `json:"siteId"`
+	IP            string     `json:"ip"`
+	Reason        string     `json:"reason"`
+	Hits          int        `json:"hits"` // hits counted in the window that triggered the ban
+	WindowSeconds int        `json:"windowSeconds"`
+	CreatedAt     time.Time  `json:"createdAt"`
+	ExpiresAt     time.Time  `json:"expiresAt"`
+	LiftedAt      *time.Time `json:"liftedAt,omitempty"`
+	LiftedBy      *int       `json:"liftedBy,omitempty"` // user who lifted the ban early
+}
+
+func (b *Ban) active(now time.Time) bool {
+	return b.LiftedAt == nil && now.Before(b.ExpiresAt)
+}
+
+// rateWindow approximates a sliding window from the counts of the current
+// and previous fixed windows, weighting the previous one by how much of it
+// still overlaps the sliding window.
+type rateWindow struct {
+	start    time.Time
+	current  int
+	previous int
+}
+
+func (w *rateWindow) add(now time.Time, size time.Duration) int {
+	switch elapsed := now.Sub(w.start); {
+	case elapsed >= 2*size:
+		w.start, w.previous, w.current = now.Truncate(size), 0, 0
+	case elapsed >= size:
+		w.start, w.previous, w.current = w.start.Add(size), w.current, 0
+	}
+	w.current++
+	overlap := 1 - float64(now.Sub(w.start))/float64(size)
+	return w.current + int(float64(w.previous)*overlap)
+}
+
+type rateShard struct {
+	mu      sync.Mutex
+	windows map[string]*rateWindow
+}
+
+// rateLimiter counts /track hits per site and IP and bans IPs that go over
+// the configured limit.
+type rateLimiter struct {
+	shards [rateLimitShards]rateShard
+
+	mu     sync.RWMutex
+	bans   map[string]*Ban // active bans by site and IP
+	recent []Ban           // ended bans, only kept when bans are not persisted
+}
+
+var trackLimiter = newRateLimiter()
+
+func newRateLimiter() *rateLimiter {
+	l := &rateLimiter{bans: map[string]*Ban{}}
+	for i := range l.shards {
+		l.shards[i].windows = map[string]*rateWindow{}
+	}
+	return l
+}
+
+func banKey(siteID, ip string) string {
+	return siteID + "|" + ip
+}
+
+// activeBan returns the ban currently in force for ip on siteID, if any.
+func (l *rateLimiter) activeBan(siteID, ip string) *Ban {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if ban, ok := l.bans[banKey(siteID, ip)]; ok && ban.active(time.Now()) {
+		return ban
+	}
+	return nil
+}
+
+// allow records a hit and reports whether the IP may be tracked. The hit
+// that pushes an IP over the limit creates a ban.
+func (l *rateLimiter) allow(siteID, ip string) bool {
+	cfg := config.RateLimit
+	if !cfg.Enabled || ip == "" {
+		return true
+	}
+	now := time.Now()
+	key := banKey(siteID, ip)
+
+	l.mu.RLock()
+	ban, banned := l.bans[key]
+	l.mu.RUnlock()
+	if banned && ban.active(now) {
+		return false
+	}
+
+	window := time.Duration(cfg.WindowSeconds) * time.Second
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	shard := &l.shards[h.Sum32()%rateLimitShards]
+	shard.mu.Lock()
+	w, ok := shard.windows[key]
+	if !ok {
+		w = &rateWindow{start: now.Truncate(window)}
+		shard.windows[key] = w
+	}
+	hits := w.add(now, window)
+	if hits > cfg.Requests {
+		delete(shard.windows, key)
+	}
+	shard.mu.Unlock()
+
+	if hits <= cfg.Requests {
+		return true
+	}
+	l.ban(siteID, ip, hits, now)
+	return false
+}
+
+func (l *rateLimiter) ban(siteID, ip string, hits int, now time.Time) {
+	cfg := config.RateLimit
+	ban := &Ban{
+		ID:            uuid.NewString(),
+		SiteID:        siteID,
+		IP:            ip,
+		Reason:        "rate limit exceeded",
+		Hits:          hits,
+		WindowSeconds: cfg.WindowSeconds,
+		CreatedAt:     now.UTC(),
+		ExpiresAt:     now.Add(time.Duration(cfg.BanMinutes) * time.Minute).UTC(),
+	}
+	l.mu.Lock()
+	l.bans[banKey(siteID, ip)] = ban
+	l.mu.Unlock()
+	log.Printf("Auto-banned %s on site %s for %d minutes after %d hits in %ds", ip, siteID, cfg.BanMinutes, hits, cfg.WindowSeconds)
+
+	if cfg.PersistBans {
+		go func() {
+			_, err := db.Exec(`INSERT INTO firewall_bans (id, site_id, ip, reason, hits, window_seconds, created_at, expires_at)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+				ban.ID, ban.SiteID, ban.IP, ban.Reason, ban.Hits, ban.WindowSeconds, ban.CreatedAt, ban.ExpiresAt)
+			if err != nil {
+				log.Printf("Error persisting ban %s: %v", ban.ID, err)
+			}
+		}()
+	}
+}
+
+// endLocked removes a ban from the active set, keeping it in the in-memory
+// history when bans are not persisted. l.mu must be held.
+func (l *rateLimiter) endLocked(key string) {
+	ban, ok := l.bans[key]
+	if !ok {
+		return
+	}
+	delete(l.bans, key)
+	if !config.RateLimit.PersistBans {
+		l.recent = append(l.recent, *ban)
+		if len(l.recent) > maxRecentBans {
+			l.recent = l.recent[len(l.recent)-maxRecentBans:]
+		}
+	}
+}
+
+// lift ends a ban early. It reports false if no such active ban exists.
+func (l *rateLimiter) lift(banID string, userID int) (*Ban, bool) {
+	now := time.Now().UTC()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, ban := range l.bans {
+		if ban.ID == banID {
+			ban.LiftedAt = &now
+			ban.LiftedBy = &userID
+			lifted := *ban
+			l.endLocked(key)
+			return &lifted, true
+		}
+	}
+	return nil, false
+}
+
+// sweep drops expired bans and idle rate windows.
+func (l *rateLimiter) sweep() {
+	now := time.Now()
+	l.mu.Lock()
+	for key, ban := range l.bans {
+		if !ban.active(now) {
+			l.endLocked(key)
+		}
+	}
+	l.mu.Unlock()
+
+	window := time.Duration(config.RateLimit.WindowSeconds) * time.Second
+	for i := range l.shards {
+		shard := &l.shards[i]
+		shard.mu.Lock()
+		for key, w := range shard.windows {
+			if now.Sub(w.start) >= 2*window {
+				delete(shard.windows, key)
+			}
+		}
+		shard.mu.Unlock()
+	}
+}
+
+// reloadBans syncs the active bans of one site, or of every site if siteID
+// is empty, with the firewall_bans table.
+func (l *rateLimiter) reloadBans(siteID string) {
+	if !config.RateLimit.PersistBans {
+		return
+	}
+	query := "SELECT id, site_id, ip, reason, hits, window_seconds, created_at, expires_at FROM firewall_bans WHERE lifted_at IS NULL AND expires_at > now()"
+	args := []any{}
+	if siteID != "" {
+		query += " AND site_id = $1"
+		args = append(args, siteID)
+	}
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		log.Printf("Error loading firewall bans: %v", err)
+		return
+	}
+	defer rows.Close()
+	active := map[string]*Ban{}
+	for rows.Next() {
+		var b Ban
+		if err := rows.Scan(&b.ID, &b.SiteID, &b.IP, &b.Reason, &b.Hits, &b.WindowSeconds, &b.CreatedAt, &b.ExpiresAt); err != nil {
+			log.Printf("Error scanning firewall ban: %v", err)
+			return
+		}
+		active[banKey(b.SiteID, b.IP)] = &b
+	}
+	if rows.Err() != nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, ban := range l.bans {
+		// Bans created in the last few seconds may not be persisted yet.
+		if (siteID == "" || ban.SiteID == siteID) && active[key] == nil && time.Since(ban.CreatedAt) > 10*time.Second {
+			delete(l.bans, key)
+		}
+	}
+	for key, ban := range active {
+		l.bans[key] = ban
+	}
+}
+
+// StartRateLimiter loads persisted bans and starts the background sweeper.
+func StartRateLimiter() {
+	trackLimiter.reloadBans("")
+	go func() {
+		for range time.Tick(time.Minute) {
+			trackLimiter.sweep()
+		}
+	}()
+}
+
+// FirewallBansApiHandler lists auto-bans and lifts them.
+func FirewallBansApiHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		handleListBans(w, r)
+	case "DELETE":
+		handleLiftBan(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// @Summary List firewall auto-bans
+// @Description List IPs banned automatically for exceeding the tracking rate limit. By default only active bans are returned; pass status=all for the audit trail.
+// @Tags firewall
+// @Produce  json
+// @Param siteId query string true "Site ID"
+// @Param status query string false "active (default) or all"
+// @Success 200 {array} Ban
+// @Router /api/firewall/bans [get]
+func handleListBans(w http.ResponseWriter, r *http.Request) {
+	siteID := r.URL.Query().Get("siteId")
+	if siteID == "" {
+		http.Error(w, "siteId query parameter is required", http.StatusBadRequest)
+		return
+	}
+	if !canAccessSite(r, siteID, ScopeFirewallManage) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = "active"
+	}
+	if status != "active" && status != "all" {
+		http.Error(w, "status must be 'active' or 'all'", http.StatusBadRequest)
+		return
+	}
+
+	var bans []Ban
+	var err error
+	if config.RateLimit.PersistBans {
+		bans, err = queryBans(siteID, status == "all")
+	} else {
+		bans = trackLimiter.listBans(siteID, status == "all")
+	}
+	if err != nil {
+		http.Error(w, "Failed to fetch bans", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bans)
+}
+
+func queryBans(siteID string, all bool) ([]Ban, error) {
+	query := `SELECT id, site_id, ip, reason, hits, window_seconds, created_at, expires_at, lifted_at, lifted_by
+		FROM firewall_bans WHERE site_id = $1`
+	if !all {
+		query += " AND lifted_at IS NULL AND expires_at > now()"
+	}
+	query += " ORDER BY created_at DESC LIMIT 1000"
+	rows, err := db.Query(query, siteID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	bans := []Ban{}
+	for rows.Next() {
+		var b Ban
+		var liftedAt sql.NullTime
+		var liftedBy sql.NullInt64
+		if err := rows.Scan(&b.ID, &b.SiteID, &b.IP, &b.Reason, &b.Hits, &b.WindowSeconds, &b.CreatedAt, &b.ExpiresAt, &liftedAt, &liftedBy); err != nil {
+			return nil, err
+		}
+		if liftedAt.Valid {
+			b.LiftedAt = &liftedAt.Time
+		}
+		if liftedBy.Valid {
+			id := int(liftedBy.Int64)
+			b.LiftedBy = &id
+		}
+		bans = append(bans, b)
+	}
+	return bans, rows.Err()
+}
+
+func (l *rateLimiter) listBans(siteID string, all bool) []Ban {
+	now := time.Now()
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	bans := []Ban{}
+	for _, ban := range l.bans {
+		if ban.SiteID == siteID && (all || ban.active(now)) {
+			bans = append(bans, *ban)
+		}
+	}
+	if all {
+		for _, ban := range l.recent {
+			if ban.SiteID == siteID {
+				bans = append(bans, ban)
+			}
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].CreatedAt.After(bans[j].CreatedAt) })
+	return bans
+}
+
+// @Summary Lift a firewall auto-ban
+// @Description End an automatic ban before it expires. The ban stays in the audit trail.
+// @Tags firewall
+// @Param id query string true "Ban ID"
+// @Success 204 "No Content"
+// @Router /api/firewall/bans [delete]
+func handleLiftBan(w http.ResponseWriter, r *http.Request) {
+	banID := r.URL.Query().Get("id")
+	if banID == "" {
+		http.Error(w, "id query parameter is required", http.StatusBadRequest)
+		return
+	}
+	userID := r.Context().Value("userID").(int)
+
+	if !config.RateLimit.PersistBans {
+		ban, ok := trackLimiter.findBan(banID)
+		if !ok {
+			http.Error(w, "Ban not found", http.StatusNotFound)
+			return
+		}
+		if !canAccessSite(r, ban.SiteID, ScopeFirewallManage) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		trackLimiter.lift(banID, userID)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var siteID string
+	err := db.QueryRow("SELECT site_id FROM firewall_bans WHERE id = $1 AND lifted_at IS NULL AND expires_at > now()", banID).Scan(&siteID)
+	if err != nil {
+		http.Error(w, "Ban not found", http.StatusNotFound)
+		return
+	}
+	if !canAccessSite(r, siteID, ScopeFirewallManage) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if _, err := db.Exec("UPDATE firewall_bans SET lifted_at = now(), lifted_by = $1 WHERE id = $2", userID, banID); err != nil {
+		http.Error(w, "Failed to lift ban", http.StatusInternalServerError)
+		return
+	}
+	trackLimiter.lift(banID, userID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (l *rateLimiter) findBan(banID string) (Ban, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, ban := range l.bans {
+		if ban.ID == banID {
+			return *ban, true
+		}
+	}
+	return Ban{}, false
+}
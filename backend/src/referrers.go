@@ -0,0 +1,153 @@
+package sentinel
+
+import (
+	"net/url"
+	"strings"
+)
+
+// directSource is the source recorded for visits without referrer or UTM tags.
+const directSource = "Direct / None"
+
+type referrerSource struct {
+	Name   string
+	Medium string // "search", "social", "email" or "referral"
+}
+
+// knownReferrers maps referrer hosts (and their parent domains) to a source.
+var knownReferrers = map[string]referrerSource{
+	"t.co":                 {"Twitter", "social"},
+	"twitter.com":          {"Twitter", "social"},
+	"x.com":                {"Twitter", "social"},
+	"facebook.com":         {"Facebook", "social"},
+	"l.facebook.com":       {"Facebook", "social"},
+	"lm.facebook.com":      {"Facebook", "social"},
+	"fb.me":                {"Facebook", "social"},
+	"instagram.com":        {"Instagram", "social"},
+	"l.instagram.com":      {"Instagram", "social"},
+	"linkedin.com":         {"LinkedIn", "social"},
+	"lnkd.in":              {"LinkedIn", "social"},
+	"reddit.com":           {"Reddit", "social"},
+	"out.reddit.com":       {"Reddit", "social"},
+	"news.ycombinator.com": {"Hacker News", "social"},
+	"youtube.com":          {"YouTube", "social"},
+	"youtu.be":             {"YouTube", "social"},
+	"pinterest.com":        {"Pinterest", "social"},
+	"tiktok.com":           {"TikTok", "social"},
+	"threads.net":          {"Threads", "social"},
+	"mastodon.social":      {"Mastodon", "social"},
+	"bsky.app":             {"Bluesky", "social"},
+	"github.com":           {"GitHub", "referral"},
+	"stackoverflow.com":    {"Stack Overflow", "referral"},
+	"producthunt.com":      {"Product Hunt", "referral"},
+	"medium.com":           {"Medium", "referral"},
+	"substack.com":         {"Substack", "email"},
+	"mail.google.com":      {"Gmail", "email"},
+	"outlook.live.com":     {"Outlook", "email"},
+	"mail.yahoo.com":       {"Yahoo Mail", "email"},
+	"duckduckgo.com":       {"DuckDuckGo", "search"},
+	"search.brave.com":     {"Brave Search", "search"},
+	"ecosia.org":           {"Ecosia", "search"},
+	"chatgpt.com":          {"ChatGPT", "referral"},
+	"perplexity.ai":        {"Perplexity", "referral"},
+}
+
+// searchBrands match search engines on any country domain, e.g. google.co.uk.
+var searchBrands = map[string]string{
+	"google": "Google",
+	"bing":   "Bing",
+	"yahoo":  "Yahoo",
+	"yandex": "Yandex",
+	"baidu":  "Baidu",
+	"naver":  "Naver",
+}
+
+// Attribution is where a hit came from, derived from UTM tags on the landing
+// URL and the referrer.
+type Attribution struct {
+	Source      string
+	Medium      string // utm_medium, or derived from the referrer
+	UTMSource   string
+	UTMMedium   string
+	UTMCampaign string
+	UTMTerm     string
+	UTMContent  string
+}
+
+// attributeTraffic parses UTM parameters from pageURL and normalizes the
+// referrer to a source name. utm_source wins over the referrer; referrers from
+// the page's own host count as direct traffic.
+func attributeTraffic(pageURL, referrer string) Attribution {
+	var a Attribution
+	var pageHost string
+	if u, err := url.Parse(pageURL); err == nil {
+		pageHost = normalizeHost(u.Hostname())
+		q := u.Query()
+		a.UTMSource = strings.TrimSpace(q.Get("utm_source"))
+		a.UTMMedium = strings.TrimSpace(q.Get("utm_medium"))
+		a.UTMCampaign = strings.TrimSpace(q.Get("utm_campaign"))
+		a.UTMTerm = strings.TrimSpace(q.Get("utm_term"))
+		a.UTMContent = strings.TrimSpace(q.Get("utm_content"))
+	}
+
+	a.Medium = strings.ToLower(a.UTMMedium)
+	if a.UTMSource != "" {
+		a.Source = strings.ToLower(a.UTMSource)
+		if known, ok := lookupReferrer(a.Source); ok {
+			a.Source = known.Name
+		}
+		return a
+	}
+
+	ref, err := url.Parse(referrer)
+	if referrer == "" || err != nil || ref.Hostname() == "" {
+		a.Source = directSource
+		return a
+	}
+	refHost := normalizeHost(ref.Hostname())
+	if refHost == pageHost {
+		a.Source = directSource
+		return a
+	}
+	if known, ok := lookupReferrer(refHost); ok {
+		a.Source = known.Name
+		if a.Medium == "" {
+			a.Medium = known.Medium
+		}
+		return a
+	}
+	a.Source = refHost
+	if a.Medium == "" {
+		a.Medium = "referral"
+	}
+	return a
+}
+
+func normalizeHost(host string) string {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, prefix := range []string{"www.", "m.", "mobile."} {
+		host = strings.TrimPrefix(host, prefix)
+	}
+	return host
+}
+
+// lookupReferrer resolves a host, or a bare name such as "twitter", to a
+// known source by trying the host and each of its parent domains.
+func lookupReferrer(host string) (referrerSource, bool) {
+	labels := strings.Split(host, ".")
+	for i := 0; i < len(labels); i++ {
+		if src, ok := knownReferrers[strings.Join(labels[i:], ".")]; ok {
+			return src, true
+		}
+	}
+	for _, label := range labels {
+		if name, ok := searchBrands[label]; ok {
+			return referrerSource{Name: name, Medium: "search"}, true
+		}
+	}
+	if len(labels) == 1 {
+		if src, ok := knownReferrers[host+".com"]; ok {
+			return src, true
+		}
+	}
+	return referrerSource{}, false
+}
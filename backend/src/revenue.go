@@ -0,0 +1,263 @@
+package sentinel
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/shopspring/decimal"
+)
+
+// baseCurrency is the currency exchange rates are expressed against.
+const baseCurrency = "USD"
+
+// Revenue is the monetary value attached to a custom event.
+type Revenue struct {
+	Amount   decimal.Decimal `json:"amount"`
+	Currency string          `json:"currency"` // ISO 4217 code, e.g. "EUR"
+}
+
+// SourceRevenue is the revenue attributed to a single traffic source.
+type SourceRevenue struct {
+	Source            string  `json:"source"`
+	Revenue           float64 `json:"revenue"`
+	Orders            uint64  `json:"orders"`
+	AverageOrderValue float64 `json:"averageOrderValue"`
+	RevenuePerVisitor float64 `json:"revenuePerVisitor"`
+}
+
+// RevenueStats are revenue totals converted into the site's reporting currency.
+// UnconvertedOrders counts revenue events left out of the totals because
+// their currency has no exchange rate.
+type RevenueStats struct {
+	Total             decimal.Decimal
+	Orders            uint64
+	AverageOrderValue decimal.Decimal
+	UnconvertedOrders uint64
+}
+
+func isCurrencyCode(code string) bool {
+	if len(code) != 3 {
+		return false
+	}
+	for _, c := range code {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeRevenue validates revenue on a tracked event. Revenue is only
+// accepted on custom events.
+func normalizeRevenue(event *Event) error {
+	if event.Revenue == nil {
+		return nil
+	}
+	if event.Name == pageviewEventName {
+		return fmt.Errorf("revenue can only be attached to custom events")
+	}
+	event.Revenue.Currency = strings.ToUpper(strings.TrimSpace(event.Revenue.Currency))
+	if !isCurrencyCode(event.Revenue.Currency) {
+		return fmt.Errorf("revenue currency must be an ISO 4217 code")
+	}
+	if event.Revenue.Amount.Abs().GreaterThanOrEqual(decimal.New(1, 14)) {
+		return fmt.Errorf("revenue amount is out of range")
+	}
+	event.Revenue.Amount = event.Revenue.Amount.Round(4)
+	return nil
+}
+
+// seedExchangeRates loads rates from the JSON file named by
+// Config.ExchangeRatesFile, a map of currency code to units per US dollar, and
+// upserts them into the exchange_rates table.
+func seedExchangeRates() {
+	path := config.ExchangeRatesFile
+	if path == "" {
+		return
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Printf("Warning: could not read exchange rates file %q: %v", path, err)
+		return
+	}
+	var rates map[string]decimal.Decimal
+	if err := json.Unmarshal(data, &rates); err != nil {
+		log.Printf("Warning: could not parse exchange rates file %q: %v", path, err)
+		return
+	}
+	for currency, rate := range rates {
+		currency = strings.ToUpper(currency)
+		if !isCurrencyCode(currency) || !rate.IsPositive() {
+			log.Printf("Warning: skipping invalid exchange rate %s=%s", currency, rate)
+			continue
+		}
+		_, err := db.Exec(`INSERT INTO exchange_rates (currency, units_per_usd) VALUES ($1, $2)
+			ON CONFLICT (currency) DO UPDATE SET units_per_usd = EXCLUDED.units_per_usd, updated_at = CURRENT_TIMESTAMP`, currency, rate.String())
+		if err != nil {
+			log.Printf("Error storing exchange rate for %s: %v", currency, err)
+		}
+	}
+	log.Printf("Loaded %d exchange rates from %s", len(rates), path)
+}
+
+// hasExchangeRate reports whether amounts in currency can be converted.
+func hasExchangeRate(currency string) (bool, error) {
+	if currency == baseCurrency {
+		return true, nil
+	}
+	var exists bool
+	err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM exchange_rates WHERE currency = $1)", currency).Scan(&exists)
+	return exists, err
+}
+
+func loadExchangeRates() (map[string]decimal.Decimal, error) {
+	rates := map[string]decimal.Decimal{baseCurrency: decimal.NewFromInt(1)}
+	rows, err := db.Query("SELECT currency, units_per_usd FROM exchange_rates")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var currency, rate string
+		if err := rows.Scan(&currency, &rate); err != nil {
+			return nil, err
+		}
+		d, err := decimal.NewFromString(rate)
+		if err != nil || !d.IsPositive() {
+			continue
+		}
+		rates[currency] = d
+	}
+	return rates, rows.Err()
+}
+
+// convertCurrency converts amount between currencies via the base currency.
+// It reports false when either rate is not configured.
+func convertCurrency(amount decimal.Decimal, from, to string, rates map[string]decimal.Decimal) (decimal.Decimal, bool) {
+	if from == to {
+		return amount, true
+	}
+	fromRate, ok := rates[from]
+	if !ok {
+		return decimal.Zero, false
+	}
+	toRate, ok := rates[to]
+	if !ok {
+		return decimal.Zero, false
+	}
+	return amount.Div(fromRate).Mul(toRate), true
+}
+
+// siteCurrency returns the site's reporting currency.
+func siteCurrency(siteID string) string {
+	if settings, err := getSiteSettings(siteID); err == nil && settings.Currency != "" {
+		return settings.Currency
+	}
+	return baseCurrency
+}
+
+// queryRevenue sums revenue events per currency and converts the totals.
+func queryRevenue(ctx context.Context, q StatsQuery, currency string, rates map[string]decimal.Decimal) (RevenueStats, error) {
+	var stats RevenueStats
+	where, args := q.where()
+	rows, err := chConn.Query(ctx, "SELECT RevenueCurrency, sum(assumeNotNull(RevenueAmount)), count() FROM events WHERE "+where+
+		" AND RevenueAmount IS NOT NULL GROUP BY RevenueCurrency", args...)
+	if err != nil {
+		return stats, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var from string
+		var amount decimal.Decimal
+		var orders uint64
+		if err := rows.Scan(&from, &amount, &orders); err != nil {
+			return stats, err
+		}
+		converted, ok := convertCurrency(amount, from, currency, rates)
+		if !ok {
+			log.Printf("Warning: no exchange rate for %s, excluding %d orders from site %s", from, orders, q.SiteID)
+			stats.UnconvertedOrders += orders
+			continue
+		}
+		stats.Total = stats.Total.Add(converted)
+		stats.Orders += orders
+	}
+	if stats.Orders > 0 {
+		stats.AverageOrderValue = stats.Total.Div(decimal.NewFromInt(int64(stats.Orders)))
+	}
+	return stats, rows.Err()
+}
+
+// queryRevenueBySource attributes converted revenue to traffic sources and
+// returns the top sources by revenue.
+func queryRevenueBySource(ctx context.Context, q StatsQuery, currency string, rates map[string]decimal.Decimal) ([]SourceRevenue, error) {
+	where, args := q.where()
+	rows, err := chConn.Query(ctx, "SELECT Source, RevenueCurrency, sum(assumeNotNull(RevenueAmount)), count() FROM events WHERE "+where+
+		" AND RevenueAmount IS NOT NULL GROUP BY Source, RevenueCurrency", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	totals := map[string]decimal.Decimal{}
+	orders := map[string]uint64{}
+	for rows.Next() {
+		var source, from string
+		var amount decimal.Decimal
+		var count uint64
+		if err := rows.Scan(&source, &from, &amount, &count); err != nil {
+			return nil, err
+		}
+		converted, ok := convertCurrency(amount, from, currency, rates)
+		if !ok {
+			continue
+		}
+		totals[source] = totals[source].Add(converted)
+		orders[source] += count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	result := []SourceRevenue{}
+	if len(totals) == 0 {
+		return result, nil
+	}
+
+	visitors := map[string]uint64{}
+	vRows, err := chConn.Query(ctx, "SELECT Source, uniq(VisitorID) FROM events WHERE "+where+" GROUP BY Source", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer vRows.Close()
+	for vRows.Next() {
+		var source string
+		var count uint64
+		if err := vRows.Scan(&source, &count); err != nil {
+			return nil, err
+		}
+		visitors[source] = count
+	}
+
+	for source, total := range totals {
+		sr := SourceRevenue{Source: source, Revenue: total.Round(2).InexactFloat64(), Orders: orders[source]}
+		if sr.Orders > 0 {
+			sr.AverageOrderValue = total.Div(decimal.NewFromInt(int64(sr.Orders))).Round(2).InexactFloat64()
+		}
+		if v := visitors[source]; v > 0 {
+			sr.RevenuePerVisitor = total.Div(decimal.NewFromInt(int64(v))).Round(2).InexactFloat64()
+		}
+		result = append(result, sr)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Revenue > result[j].Revenue })
+	if len(result) > 10 {
+		result = result[:10]
+	}
+	return result, nil
+}
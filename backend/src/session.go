@@ -46,17 +46,10 @@ func SessionHandler(w http.ResponseWriter, r *http.Request) {
 		Events:    payload.Events,
 	}
 
-	// Insert into ClickHouse
-	ctx := context.Background()
-	err := chConn.AsyncInsert(ctx, "INSERT INTO session_events VALUES (?, ?, ?, ?)", false,
-		sessionData.Timestamp,
-		sessionData.SiteID,
-		sessionData.SessionID,
-		string(sessionData.Events), // Convert events to string for storage
-	)
-	if err != nil {
-		log.Printf("Error inserting session into ClickHouse: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	// Queue for batched insertion into ClickHouse
+	if !sessionIngester.Enqueue(sessionData) {
+		log.Printf("Ingestion queue full, dropping session events for site %s", sessionData.SiteID)
+		http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
 		return
 	}
 
@@ -1,16 +1,74 @@
 package sentinel
 
 import (
+	"database/sql"
 	"encoding/json"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
 )
 
 // Site struct represents a website being tracked in the database.
 type Site struct {
-	ID     string `json:"id"`
-	Name   string `json:"name"`
-	Domain string `json:"domain,omitempty"`
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Domain   string `json:"domain,omitempty"`
+	StoreIP  bool   `json:"storeIp"`  // persist raw client IPs alongside events
+	Timezone string `json:"timezone"` // IANA zone used for dashboard date ranges
+	Currency string `json:"currency"` // ISO 4217 reporting currency for revenue
+}
+
+// SiteSettings holds the per-site options the tracking path needs on every hit.
+type SiteSettings struct {
+	StoreIP  bool
+	Timezone string
+	Currency string
+}
+
+const siteSettingsTTL = time.Minute
+
+type cachedSiteSettings struct {
+	settings SiteSettings
+	loadedAt time.Time
+}
+
+var (
+	siteSettingsMu    sync.RWMutex
+	siteSettingsCache = map[string]cachedSiteSettings{}
+)
+
+// getSiteSettings returns a site's settings, cached briefly so /track does
+// not hit Postgres for every event. It returns sql.ErrNoRows for unknown
+// sites, which are not cached.
+func getSiteSettings(siteID string) (SiteSettings, error) {
+	siteSettingsMu.RLock()
+	cached, ok := siteSettingsCache[siteID]
+	siteSettingsMu.RUnlock()
+	if ok && time.Since(cached.loadedAt) < siteSettingsTTL {
+		return cached.settings, nil
+	}
+
+	var settings SiteSettings
+	if _, err := uuid.Parse(siteID); err != nil {
+		return settings, sql.ErrNoRows
+	}
+	err := db.QueryRow("SELECT store_ip, timezone, currency FROM sites WHERE id = $1", siteID).Scan(&settings.StoreIP, &settings.Timezone, &settings.Currency)
+	if err != nil {
+		return settings, err
+	}
+	siteSettingsMu.Lock()
+	siteSettingsCache[siteID] = cachedSiteSettings{settings: settings, loadedAt: time.Now()}
+	siteSettingsMu.Unlock()
+	return settings, nil
+}
+
+func invalidateSiteSettings(siteID string) {
+	siteSettingsMu.Lock()
+	delete(siteSettingsCache, siteID)
+	siteSettingsMu.Unlock()
 }
 
 // SitesApiHandler now routes to different functions based on the request.
@@ -35,6 +93,23 @@ func SitesApiHandler(w http.ResponseWriter, r *http.Request) {
 	// If the path is not empty, it should be an ID for a specific site
 	// (PUT update, DELETE remove)
 	siteID := path[1:] // remove the leading "/"
+
+	// Sub-resources of a site, e.g. /api/sites/{id}/keys/{keyId}
+	if parts := strings.SplitN(siteID, "/", 3); len(parts) > 1 {
+		siteID = parts[0]
+		switch parts[1] {
+		case "keys":
+			keyID := ""
+			if len(parts) == 3 {
+				keyID = parts[2]
+			}
+			handleSiteKeys(w, r, siteID, keyID)
+		default:
+			http.Error(w, "Not found", http.StatusNotFound)
+		}
+		return
+	}
+
 	switch r.Method {
 	case "PUT":
 		handleUpdateSite(w, r, siteID)
@@ -54,7 +129,7 @@ func SitesApiHandler(w http.ResponseWriter, r *http.Request) {
 func handleListSites(w http.ResponseWriter, r *http.Request) {
 	userID := r.Context().Value("userID").(int)
 
-	rows, err := db.Query("SELECT id, name, domain FROM sites WHERE user_id = $1 ORDER BY created_at DESC", userID)
+	rows, err := db.Query("SELECT id, name, domain, store_ip, timezone, currency FROM sites WHERE user_id = $1 ORDER BY created_at DESC", userID)
 	if err != nil {
 		http.Error(w, "Failed to fetch sites", http.StatusInternalServerError)
 		return
@@ -64,7 +139,7 @@ func handleListSites(w http.ResponseWriter, r *http.Request) {
 	sites := []Site{}
 	for rows.Next() {
 		var s Site
-		if err := rows.Scan(&s.ID, &s.Name, &s.Domain); err != nil {
+		if err := rows.Scan(&s.ID, &s.Name, &s.Domain, &s.StoreIP, &s.Timezone, &s.Currency); err != nil {
 			http.Error(w, "Failed to scan site", http.StatusInternalServerError)
 			return
 		}
@@ -90,8 +165,24 @@ func handleCreateSite(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if site.Timezone == "" {
+		site.Timezone = "UTC"
+	}
+	if _, err := time.LoadLocation(site.Timezone); err != nil {
+		http.Error(w, "Invalid timezone", http.StatusBadRequest)
+		return
+	}
+	site.Currency = strings.ToUpper(site.Currency)
+	if site.Currency == "" {
+		site.Currency = baseCurrency
+	}
+	if !isCurrencyCode(site.Currency) {
+		http.Error(w, "Invalid currency", http.StatusBadRequest)
+		return
+	}
+
 	var newSiteID string
-	err := db.QueryRow("INSERT INTO sites (user_id, name, domain) VALUES ($1, $2, $3) RETURNING id", userID, site.Name, site.Domain).Scan(&newSiteID)
+	err := db.QueryRow("INSERT INTO sites (user_id, name, domain, store_ip, timezone, currency) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id", userID, site.Name, site.Domain, site.StoreIP, site.Timezone, site.Currency).Scan(&newSiteID)
 	if err != nil {
 		http.Error(w, "Failed to create site", http.StatusInternalServerError)
 		return
@@ -103,36 +194,79 @@ func handleCreateSite(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(site)
 }
 
+// SiteUpdate is the body of a site update. Fields left out of the request
+// keep their current values.
+type SiteUpdate struct {
+	Name     *string `json:"name"`
+	Domain   *string `json:"domain"`
+	StoreIP  *bool   `json:"storeIp"`
+	Timezone *string `json:"timezone"`
+	Currency *string `json:"currency"`
+}
+
 // @Summary Update a site
-// @Description Update an existing site.
+// @Description Update an existing site. Only the fields present in the body are changed.
 // @Tags sites
 // @Accept  json
 // @Produce  json
 // @Param id path string true "Site ID"
-// @Param site body Site true "Site to update"
+// @Param site body SiteUpdate true "Fields to update"
 // @Success 200 {object} Site
 // @Router /api/sites/{id} [put]
 func handleUpdateSite(w http.ResponseWriter, r *http.Request, siteID string) {
 	userID := r.Context().Value("userID").(int)
-	var site Site
-	if err := json.NewDecoder(r.Body).Decode(&site); err != nil {
+	var update SiteUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	// Check for ownership before updating
+	// Check for ownership and load the current values before updating
 	var ownerID int
-	err := db.QueryRow("SELECT user_id FROM sites WHERE id = $1", siteID).Scan(&ownerID)
+	site := Site{ID: siteID}
+	err := db.QueryRow("SELECT user_id, name, domain, store_ip, timezone, currency FROM sites WHERE id = $1", siteID).
+		Scan(&ownerID, &site.Name, &site.Domain, &site.StoreIP, &site.Timezone, &site.Currency)
 	if err != nil || ownerID != userID {
 		http.Error(w, "Forbidden", http.StatusForbidden)
 		return
 	}
 
-	_, err = db.Exec("UPDATE sites SET name = $1, domain = $2 WHERE id = $3 AND user_id = $4", site.Name, site.Domain, siteID, userID)
+	if update.Name != nil {
+		site.Name = *update.Name
+	}
+	if update.Domain != nil {
+		site.Domain = *update.Domain
+	}
+	if update.StoreIP != nil {
+		site.StoreIP = *update.StoreIP
+	}
+	if update.Timezone != nil {
+		site.Timezone = *update.Timezone
+		if site.Timezone == "" {
+			site.Timezone = "UTC"
+		}
+		if _, err := time.LoadLocation(site.Timezone); err != nil {
+			http.Error(w, "Invalid timezone", http.StatusBadRequest)
+			return
+		}
+	}
+	if update.Currency != nil {
+		site.Currency = strings.ToUpper(*update.Currency)
+		if site.Currency == "" {
+			site.Currency = baseCurrency
+		}
+		if !isCurrencyCode(site.Currency) {
+			http.Error(w, "Invalid currency", http.StatusBadRequest)
+			return
+		}
+	}
+
+	_, err = db.Exec("UPDATE sites SET name = $1, domain = $2, store_ip = $3, timezone = $4, currency = $5 WHERE id = $6 AND user_id = $7", site.Name, site.Domain, site.StoreIP, site.Timezone, site.Currency, siteID, userID)
 	if err != nil {
 		http.Error(w, "Failed to update site", http.StatusInternalServerError)
 		return
 	}
+	invalidateSiteSettings(siteID)
 
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(site)
@@ -160,6 +294,7 @@ func handleDeleteSite(w http.ResponseWriter, r *http.Request, siteID string) {
 		http.Error(w, "Failed to delete site", http.StatusInternalServerError)
 		return
 	}
+	invalidateSiteSettings(siteID)
 
 	w.WriteHeader(http.StatusNoContent)
 }
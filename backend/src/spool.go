@@ -0,0 +1,327 @@
+package sentinel
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	spoolSegmentBytes = 8 << 20
+	spoolSegmentExt   = ".seg"
+	spoolOffsetExt    = ".offset" // sidecar holding how far a segment was replayed
+	spoolQuarantine   = "quarantine.jsonl"
+)
+
+var errSpoolFull = errors.New("spool is full")
+
+// spool is a write-ahead log of rows that could not be inserted into
+// ClickHouse. Rows are appended as newline-delimited records to segment files
+// named after their creation time, so replaying segments by name preserves
+// the order rows were spooled in. Replay progress through the oldest segment
+// is saved to a sidecar file, so a restart resumes mid-segment instead of
+// inserting its rows again.
+type spool struct {
+	dir      string
+	maxBytes int64
+
+	mu       sync.Mutex
+	segments []spoolSegment // oldest first; the last one may be active
+	active   *os.File
+	total    int64
+	replayed int // lines already replayed from segments[0]
+}
+
+type spoolSegment struct {
+	path    string
+	created time.Time
+	size    int64
+}
+
+// SpoolStats reports how much data is waiting on disk.
+type SpoolStats struct {
+	Segments         int     `json:"segments"`
+	SpooledBytes     int64   `json:"spooledBytes"`
+	MaxBytes         int64   `json:"maxBytes"`
+	OldestUnsentAge  float64 `json:"oldestUnsentAgeSeconds"`
+	OldestUnsentTime *string `json:"oldestUnsentTime,omitempty"`
+}
+
+// openSpool opens (or creates) the spool in dir and picks up any segments
+// left behind by a previous run.
+func openSpool(dir string, maxBytes int64) (*spool, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	s := &spool{dir: dir, maxBytes: maxBytes}
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), spoolSegmentExt) {
+			continue
+		}
+		nanos, err := strconv.ParseInt(strings.TrimSuffix(e.Name(), spoolSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		s.segments = append(s.segments, spoolSegment{
+			path:    filepath.Join(dir, e.Name()),
+			created: time.Unix(0, nanos),
+			size:    info.Size(),
+		})
+		s.total += info.Size()
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].created.Before(s.segments[j].created) })
+	if len(s.segments) > 0 {
+		s.replayed = readSpoolOffset(s.segments[0].path)
+		log.Printf("Found %d spooled segments (%d bytes) in %s, resuming at line %d", len(s.segments), s.total, dir, s.replayed)
+	}
+	return s, nil
+}
+
+// write appends records to the active segment and syncs them to disk.
+func (s *spool) write(records [][]byte) error {
+	var buf bytes.Buffer
+	for _, rec := range records {
+		buf.Write(rec)
+		buf.WriteByte('\n')
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.total+int64(buf.Len()) > s.maxBytes {
+		return errSpoolFull
+	}
+	if s.active == nil || s.segments[len(s.segments)-1].size >= spoolSegmentBytes {
+		if err := s.rotateLocked(); err != nil {
+			return err
+		}
+	}
+	n, err := s.active.Write(buf.Bytes())
+	s.segments[len(s.segments)-1].size += int64(n)
+	s.total += int64(n)
+	if err != nil {
+		return err
+	}
+	return s.active.Sync()
+}
+
+func (s *spool) rotateLocked() error {
+	s.sealLocked()
+	created := time.Now()
+	if n := len(s.segments); n > 0 && !created.After(s.segments[n-1].created) {
+		created = s.segments[n-1].created.Add(time.Nanosecond)
+	}
+	path := filepath.Join(s.dir, fmt.Sprintf("%020d%s", created.UnixNano(), spoolSegmentExt))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	s.active = f
+	s.segments = append(s.segments, spoolSegment{path: path, created: created})
+	return nil
+}
+
+func (s *spool) sealLocked() {
+	if s.active != nil {
+		s.active.Close()
+		s.active = nil
+	}
+}
+
+// pending reports whether any records are waiting to be replayed.
+func (s *spool) pending() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.total > 0
+}
+
+// oldest seals the oldest segment if it is still being written to and
+// returns it along with the number of lines already replayed from it.
+func (s *spool) oldest() (spoolSegment, int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.segments) == 0 {
+		return spoolSegment{}, 0, false
+	}
+	if len(s.segments) == 1 {
+		s.sealLocked()
+	}
+	return s.segments[0], s.replayed, true
+}
+
+// advance records that the first lines of seg were replayed and saves the
+// position next to the segment. A crash between a send and this write can
+// still repeat that one batch.
+func (s *spool) advance(seg spoolSegment, lines int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.segments) == 0 || s.segments[0].path != seg.path {
+		return nil
+	}
+	s.replayed = lines
+	tmp := seg.path + spoolOffsetExt + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.Itoa(lines)), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, seg.path+spoolOffsetExt)
+}
+
+// readSpoolOffset returns the saved replay position of a segment, or 0 if
+// none was saved.
+func readSpoolOffset(segPath string) int {
+	b, err := os.ReadFile(segPath + spoolOffsetExt)
+	if err != nil {
+		return 0
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || n < 0 {
+		log.Printf("Ignoring invalid spool offset for %s: %q", segPath, b)
+		return 0
+	}
+	return n
+}
+
+// remove deletes the oldest segment once it has been fully replayed.
+func (s *spool) remove(seg spoolSegment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.segments) == 0 || s.segments[0].path != seg.path {
+		return nil
+	}
+	if err := os.Remove(seg.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := os.Remove(seg.path + spoolOffsetExt); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Error removing spool offset for %s: %v", seg.path, err)
+	}
+	s.total -= s.segments[0].size
+	s.segments = s.segments[1:]
+	s.replayed = 0
+	return nil
+}
+
+// quarantine appends records that can never be inserted to a file in the
+// spool directory, where they are kept for inspection instead of blocking
+// replay. Like the spool, the file is capped at maxBytes.
+func (s *spool) quarantine(records [][]byte) error {
+	var buf bytes.Buffer
+	for _, rec := range records {
+		buf.Write(rec)
+		buf.WriteByte('\n')
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	path := filepath.Join(s.dir, spoolQuarantine)
+	if info, err := os.Stat(path); err == nil && info.Size()+int64(buf.Len()) > s.maxBytes {
+		return errSpoolFull
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// replay feeds the records of every spooled segment, oldest first, to send in
+// chunks of at most batchSize. It stops at the first send error; progress is
+// saved so the next call, or the next process, resumes where this one left
+// off.
+func (s *spool) replay(batchSize int, send func([][]byte) error) error {
+	for {
+		seg, skip, ok := s.oldest()
+		if !ok {
+			return nil
+		}
+		if err := s.replaySegment(seg, skip, batchSize, send); err != nil {
+			return err
+		}
+		if err := s.remove(seg); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *spool) replaySegment(seg spoolSegment, skip, batchSize int, send func([][]byte) error) error {
+	f, err := os.Open(seg.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	chunk := make([][]byte, 0, batchSize)
+	line := 0 // lines read so far
+	flush := func() error {
+		if len(chunk) == 0 {
+			return nil
+		}
+		if err := send(chunk); err != nil {
+			return err
+		}
+		chunk = chunk[:0]
+		if err := s.advance(seg, line); err != nil {
+			log.Printf("Error saving replay position of spool segment %s: %v", seg.path, err)
+		}
+		return nil
+	}
+	for scanner.Scan() {
+		line++
+		if line <= skip || len(scanner.Bytes()) == 0 {
+			continue
+		}
+		chunk = append(chunk, bytes.Clone(scanner.Bytes()))
+		if len(chunk) >= batchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("Error reading spool segment %s, skipping remainder: %v", seg.path, err)
+	}
+	return flush()
+}
+
+func (s *spool) close() {
+	s.mu.Lock()
+	s.sealLocked()
+	s.mu.Unlock()
+}
+
+func (s *spool) stats() SpoolStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := SpoolStats{Segments: len(s.segments), SpooledBytes: s.total, MaxBytes: s.maxBytes}
+	if s.total > 0 {
+		oldest := s.segments[0].created
+		st.OldestUnsentAge = time.Since(oldest).Seconds()
+		ts := oldest.UTC().Format(time.RFC3339)
+		st.OldestUnsentTime = &ts
+	}
+	return st
+}
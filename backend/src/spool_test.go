@@ -0,0 +1,85 @@
+package sentinel
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSpoolReplayResumesAfterReopen(t *testing.T) {
+	dir := t.TempDir()
+	sp, err := openSpool(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sp.write([][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d"), []byte("e")}); err != nil {
+		t.Fatal(err)
+	}
+
+	var sent []string
+	errDown := errors.New("clickhouse down")
+	err = sp.replay(2, func(records [][]byte) error {
+		if len(sent) == 2 {
+			return errDown
+		}
+		for _, rec := range records {
+			sent = append(sent, string(rec))
+		}
+		return nil
+	})
+	if !errors.Is(err, errDown) {
+		t.Fatalf("replay error = %v, want %v", err, errDown)
+	}
+	sp.close()
+
+	// A new process picks up where the first one stopped.
+	sp, err = openSpool(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sp.replay(2, func(records [][]byte) error {
+		for _, rec := range records {
+			sent = append(sent, string(rec))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(sent, ""); got != "abcde" {
+		t.Errorf("replayed %q, want %q", got, "abcde")
+	}
+	if sp.pending() {
+		t.Error("spool still pending after full replay")
+	}
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		t.Errorf("left behind %s", e.Name())
+	}
+}
+
+func TestSpoolQuarantine(t *testing.T) {
+	dir := t.TempDir()
+	sp, err := openSpool(dir, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sp.quarantine([][]byte{[]byte("bad")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sp.quarantine([][]byte{[]byte("worse")}); !errors.Is(err, errSpoolFull) {
+		t.Errorf("quarantine past maxBytes: err = %v, want %v", err, errSpoolFull)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, spoolQuarantine))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "bad\n" {
+		t.Errorf("quarantine file = %q, want %q", b, "bad\n")
+	}
+	if sp.pending() {
+		t.Error("quarantined records count as pending")
+	}
+}
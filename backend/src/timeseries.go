@@ -0,0 +1,213 @@
+package sentinel
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"time"
+)
+
+const maxTimeseriesBuckets = 5000
+
+// TimeseriesPoint is the value of a metric in the bucket starting at Date.
+type TimeseriesPoint struct {
+	Date  time.Time `json:"date"`
+	Value float64   `json:"value"`
+}
+
+// Timeseries is a bucketed series of a single dashboard metric.
+type Timeseries struct {
+	Metric   string            `json:"metric"`
+	Interval string            `json:"interval"`
+	Timezone string            `json:"timezone"`
+	Points   []TimeseriesPoint `json:"points"`
+}
+
+// timeseriesMetrics maps metric names to their per-bucket aggregate over events.
+var timeseriesMetrics = map[string]string{
+	"views":           "countIf(EventName = 'pageview' AND LCP IS NULL AND CLS IS NULL AND FID IS NULL)",
+	"visitors":        "uniq(VisitorID)",
+	"avg_lcp":         "ifNotFinite(avg(LCP), 0)",
+	"avg_cls":         "ifNotFinite(avg(CLS), 0)",
+	"avg_fid":         "ifNotFinite(avg(FID), 0)",
+	"traffic_quality": "ifNotFinite(countIf(TrustScore > 50) / countIf(EventName = 'pageview' AND LCP IS NULL AND CLS IS NULL AND FID IS NULL) * 100, 0)",
+	"bounce_rate":     "", // computed over visits, see queryTimeseries
+}
+
+// bucketExpr returns the ClickHouse expression truncating column to the start
+// of its interval in the given time zone.
+func bucketExpr(interval, column string, loc *time.Location) (string, error) {
+	tz := loc.String()
+	switch interval {
+	case "hour":
+		return fmt.Sprintf("toStartOfHour(%s, '%s')", column, tz), nil
+	case "day":
+		return fmt.Sprintf("toDateTime(toStartOfDay(%s, '%s'), '%s')", column, tz, tz), nil
+	case "week":
+		return fmt.Sprintf("toDateTime(toStartOfWeek(%s, 1, '%s'), '%s')", column, tz, tz), nil
+	case "month":
+		return fmt.Sprintf("toDateTime(toStartOfMonth(%s, '%s'), '%s')", column, tz, tz), nil
+	}
+	return "", fmt.Errorf("invalid interval %q. Must be 'hour', 'day', 'week', or 'month'", interval)
+}
+
+// truncateToInterval mirrors bucketExpr in Go so empty buckets can be filled.
+func truncateToInterval(t time.Time, interval string) time.Time {
+	y, m, d := t.Date()
+	switch interval {
+	case "hour":
+		return time.Date(y, m, d, t.Hour(), 0, 0, 0, t.Location())
+	case "week":
+		offset := (int(t.Weekday()) + 6) % 7 // days since Monday
+		return time.Date(y, m, d-offset, 0, 0, 0, 0, t.Location())
+	case "month":
+		return time.Date(y, m, 1, 0, 0, 0, 0, t.Location())
+	}
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+func nextInterval(t time.Time, interval string) time.Time {
+	switch interval {
+	case "hour":
+		return t.Add(time.Hour)
+	case "week":
+		return t.AddDate(0, 0, 7)
+	case "month":
+		return t.AddDate(0, 1, 0)
+	}
+	return t.AddDate(0, 0, 1)
+}
+
+// @Summary Metric time series
+// @Description Get a dashboard metric bucketed over time, with empty buckets filled with zeros.
+// @Tags dashboard
+// @Produce  json
+// @Param siteId query string true "Site ID"
+// @Param metric query string true "views, visitors, bounce_rate, avg_lcp, avg_cls, avg_fid or traffic_quality"
+// @Param from query string false "Start date (YYYY-MM-DD or RFC 3339)"
+// @Param to query string false "End date, inclusive (YYYY-MM-DD or RFC 3339)"
+// @Param interval query string false "hour, day (default), week or month"
+// @Param tz query string false "IANA time zone used for bucketing (defaults to the site's time zone)"
+// @Param filter query []string false "Filters as dimension:operator:value, e.g. country:is:DE" collectionFormat(multi)
+// @Success 200 {object} Timeseries
+// @Router /api/timeseries [get]
+func TimeseriesApiHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	siteID := q.Get("siteId")
+	if siteID == "" {
+		http.Error(w, "siteId query parameter is required", http.StatusBadRequest)
+		return
+	}
+	if !canAccessSite(r, siteID, ScopeStatsRead) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	metric := q.Get("metric")
+	if _, ok := timeseriesMetrics[metric]; !ok {
+		http.Error(w, "Invalid metric. Must be 'views', 'visitors', 'bounce_rate', 'avg_lcp', 'avg_cls', 'avg_fid', or 'traffic_quality'", http.StatusBadRequest)
+		return
+	}
+	interval := q.Get("interval")
+	if interval == "" {
+		interval = "day"
+	}
+	if _, err := bucketExpr(interval, "Timestamp", time.UTC); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dr, err := siteDateRange(r, siteID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	buckets, err := timeseriesBuckets(dr, interval)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	filters, err := parseFilters(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	series, err := queryTimeseries(context.Background(), StatsQuery{SiteID: siteID, Range: dr, Filters: filters}, metric, interval, buckets)
+	if err != nil {
+		log.Printf("Error querying timeseries: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(series)
+}
+
+// timeseriesBuckets lays out the start of every bucket in the range, so
+// buckets without events can be returned as zeros.
+func timeseriesBuckets(dr DateRange, interval string) ([]time.Time, error) {
+	var buckets []time.Time
+	for t := truncateToInterval(dr.From.In(dr.Location), interval); t.Before(dr.To); t = nextInterval(t, interval) {
+		buckets = append(buckets, t)
+		if len(buckets) > maxTimeseriesBuckets {
+			return nil, fmt.Errorf("range produces more than %d buckets, use a larger interval", maxTimeseriesBuckets)
+		}
+	}
+	return buckets, nil
+}
+
+func queryTimeseries(ctx context.Context, sq StatsQuery, metric, interval string, buckets []time.Time) (Timeseries, error) {
+	dr := sq.Range
+	series := Timeseries{Metric: metric, Interval: interval, Timezone: dr.Location.String(), Points: []TimeseriesPoint{}}
+	where, whereArgs := sq.where()
+
+	var query string
+	var args []any
+	if metric == "bounce_rate" {
+		bucket, err := bucketExpr(interval, "start", dr.Location)
+		if err != nil {
+			return series, err
+		}
+		query = "SELECT " + bucket + " AS bucket, countIf(pageviews = 1) / count() * 100 FROM (" +
+			visitsSubquery(where) + ") GROUP BY bucket ORDER BY bucket"
+		args = append([]any{visitTimeoutSeconds()}, whereArgs...)
+	} else {
+		bucket, err := bucketExpr(interval, "Timestamp", dr.Location)
+		if err != nil {
+			return series, err
+		}
+		query = "SELECT " + bucket + " AS bucket, toFloat64(" + timeseriesMetrics[metric] + ") FROM events WHERE " + where + " GROUP BY bucket ORDER BY bucket"
+		args = whereArgs
+	}
+
+	rows, err := chConn.Query(ctx, query, args...)
+	if err != nil {
+		return series, err
+	}
+	defer rows.Close()
+
+	values := map[int64]float64{}
+	for rows.Next() {
+		var bucket time.Time
+		var value float64
+		if err := rows.Scan(&bucket, &value); err != nil {
+			return series, err
+		}
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			value = 0
+		}
+		values[bucket.Unix()] = value
+	}
+
+	for _, b := range buckets {
+		series.Points = append(series.Points, TimeseriesPoint{Date: b, Value: values[b.Unix()]})
+	}
+	return series, nil
+}
@@ -0,0 +1,74 @@
+package sentinel
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"log"
+	"sync"
+	"time"
+)
+
+// Visitors are identified by a hash of a daily-rotating salt, the site ID, the
+// client IP and the user agent. Salts older than a day are deleted, so a
+// visitor ID cannot be linked back to an IP or across days.
+
+// visitorIDLifetime is how long a visitor ID stays the same: from one UTC
+// midnight to the next.
+const visitorIDLifetime = 24 * time.Hour
+
+var (
+	saltMu  sync.Mutex
+	saltDay string
+	salt    []byte
+)
+
+// currentSalt returns the salt for the current UTC day, creating it in
+// Postgres on first use so every replica hashes with the same value.
+func currentSalt() ([]byte, error) {
+	day := time.Now().UTC().Format("2006-01-02")
+
+	saltMu.Lock()
+	defer saltMu.Unlock()
+	if day == saltDay && salt != nil {
+		return salt, nil
+	}
+
+	fresh := make([]byte, 32)
+	if _, err := rand.Read(fresh); err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec("INSERT INTO visitor_salts (day, salt) VALUES ($1, $2) ON CONFLICT (day) DO NOTHING", day, fresh); err != nil {
+		return nil, err
+	}
+	var stored []byte
+	if err := db.QueryRow("SELECT salt FROM visitor_salts WHERE day = $1", day).Scan(&stored); err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec("DELETE FROM visitor_salts WHERE day < $1::date - 1", day); err != nil {
+		log.Printf("Error pruning visitor salts: %v", err)
+	}
+
+	saltDay, salt = day, stored
+	return salt, nil
+}
+
+// visitorID derives the privacy-preserving visitor identifier for a hit.
+func visitorID(siteID, ip, userAgent string) (uint64, error) {
+	s, err := currentSalt()
+	if err != nil {
+		return 0, err
+	}
+	return hashVisitor(s, siteID, ip, userAgent), nil
+}
+
+// hashVisitor hashes a hit's site, IP and user agent with the day's salt.
+func hashVisitor(salt []byte, siteID, ip, userAgent string) uint64 {
+	h := sha256.New()
+	h.Write(salt)
+	for _, part := range []string{siteID, ip, userAgent} {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return binary.BigEndian.Uint64(h.Sum(nil)[:8])
+}
@@ -0,0 +1,63 @@
+package sentinel
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// VisitTimeout is the inactivity gap after which a visitor's next pageview
+// starts a new visit. It is set from Config.VisitTimeoutMinutes.
+var VisitTimeout = 30 * time.Minute
+
+// visitsSubquery splits each visitor's pageviews into visits at gaps longer
+// than VisitTimeout and yields one row per visit. where selects the events
+// considered; its bind arguments follow the gap in seconds.
+func visitsSubquery(where string) string {
+	return fmt.Sprintf(`
+		SELECT
+			VisitorID,
+			visit,
+			count() AS pageviews,
+			min(Timestamp) AS start,
+			date_diff('second', min(Timestamp), max(Timestamp)) AS duration,
+			argMin(URL, Timestamp) AS entry_page,
+			argMax(URL, Timestamp) AS exit_page
+		FROM (
+			SELECT VisitorID, Timestamp, URL,
+				sum(is_new) OVER (PARTITION BY VisitorID ORDER BY Timestamp ROWS BETWEEN UNBOUNDED PRECEDING AND CURRENT ROW) AS visit
+			FROM (
+				SELECT VisitorID, Timestamp, URL,
+					date_diff('second', lagInFrame(Timestamp, 1, toDateTime(0)) OVER (PARTITION BY VisitorID ORDER BY Timestamp ROWS BETWEEN 1 PRECEDING AND CURRENT ROW), Timestamp) > ? AS is_new
+				FROM events
+				WHERE %s AND EventName = 'pageview' AND LCP IS NULL AND CLS IS NULL AND FID IS NULL
+			)
+		)
+		GROUP BY VisitorID, visit`, where)
+}
+
+func visitTimeoutSeconds() int {
+	return int(VisitTimeout / time.Second)
+}
+
+// queryTopVisitPages returns the most common entry or exit pages of visits.
+// column must be "entry_page" or "exit_page".
+func queryTopVisitPages(ctx context.Context, column string, q StatsQuery) ([]CountStat, error) {
+	where, args := q.where()
+	query := "SELECT " + column + ", count() AS c FROM (" + visitsSubquery(where) + ") GROUP BY " + column + " ORDER BY c DESC LIMIT 10"
+	rows, err := chConn.Query(ctx, query, append([]any{visitTimeoutSeconds()}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []CountStat
+	for rows.Next() {
+		var stat CountStat
+		if err := rows.Scan(&stat.Value, &stat.Count); err != nil {
+			return nil, err
+		}
+		result = append(result, stat)
+	}
+	return result, nil
+}
@@ -61,6 +61,19 @@
             track(vital);
         };
 
+        // Expose a global function for custom events, e.g.
+        // sentinel.track('signup_clicked', { plan: 'pro' })
+        // An optional third argument attaches revenue, e.g.
+        // sentinel.track('purchase', { plan: 'pro' }, { amount: 49.99, currency: 'EUR' })
+        window.sentinel = window.sentinel || {};
+        window.sentinel.track = (name, props = {}, revenue) => {
+            const payload = { name: name, props: props };
+            if (revenue) {
+                payload.revenue = { amount: revenue.amount, currency: revenue.currency };
+            }
+            track(payload);
+        };
+
 
         // --- SPA Tracking ---
         // Track initial page view
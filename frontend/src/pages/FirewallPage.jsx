@@ -5,6 +5,7 @@ const FirewallPage = () => {
   const [rules, setRules] = useState([]);
   const [ruleType, setRuleType] = useState('ip');
   const [value, setValue] = useState('');
+  const [action, setAction] = useState('block');
   const [loading, setLoading] = useState(true);
   const [error, setError] = useState(null);
 
@@ -37,7 +38,7 @@ const FirewallPage = () => {
       return;
     }
     try {
-      await api.addFirewallRule(siteId, { rule_type: ruleType, value });
+      await api.addFirewallRule(siteId, { rule_type: ruleType, value, action });
       setValue('');
       fetchRules(); // Refresh the list
     } catch (err) {
@@ -69,7 +70,7 @@ const FirewallPage = () => {
       <h1 className="text-2xl font-bold mb-6">Sentinel Firewall</h1>
       <p className="text-slate-400 mb-8">
         Configure rules to block unwanted traffic from being recorded in your analytics. 
-        These rules prevent tracking events from specified IPs, countries, or ASNs, 
+        These rules match tracking events by IP, country, ASN, user agent, referrer, path, hostname or trust score, 
         but do not block direct access to your website.
       </p>
 
@@ -84,14 +85,30 @@ const FirewallPage = () => {
             <option value="ip">IP Address</option>
             <option value="country">Country (2-letter code)</option>
             <option value="asn">ASN</option>
+            <option value="user_agent">User agent (text or /regex/)</option>
+            <option value="referrer_host">Referrer host</option>
+            <option value="path">Path (glob, e.g. /admin/*)</option>
+            <option value="hostname">Hostname</option>
+            <option value="trust_below">Trust score below</option>
           </select>
           <input
             type="text"
             value={value}
             onChange={(e) => setValue(e.target.value)}
-            placeholder="Enter value to block"
+            placeholder="Enter value to match"
             className="flex-grow p-2 border rounded-md bg-white dark:bg-gray-700"
           />
+          <select
+            value={action}
+            onChange={(e) => setAction(e.target.value)}
+            className="p-2 border rounded-md bg-white dark:bg-gray-700"
+          >
+            <option value="block">Block</option>
+            <option value="allow">Allow</option>
+            <option value="challenge">Challenge (exclude from stats, log for review)</option>
+            <option value="tag">Tag (exclude from stats)</option>
+            <option value="log_only">Log only (dry run)</option>
+          </select>
           <button type="submit" className="bg-blue-500 text-white px-4 py-2 rounded-md hover:bg-blue-600">
             Add Rule
           </button>
@@ -107,6 +124,10 @@ const FirewallPage = () => {
               <tr className="border-b">
                 <th className="text-left p-2">Type</th>
                 <th className="text-left p-2">Value</th>
+                <th className="text-left p-2">Action</th>
+                <th className="text-left p-2">Note</th>
+                <th className="text-right p-2">Hits (24h)</th>
+                <th className="text-left p-2">Last hit</th>
                 <th className="text-right p-2">Actions</th>
               </tr>
             </thead>
@@ -116,6 +137,10 @@ const FirewallPage = () => {
                   <tr key={rule.id} className="border-b">
                     <td className="p-2">{rule.rule_type}</td>
                     <td className="p-2">{rule.value}</td>
+                    <td className="p-2">{rule.action}</td>
+                    <td className="p-2">{rule.note}</td>
+                    <td className="text-right p-2">{rule.hits} ({rule.hits_24h})</td>
+                    <td className="p-2">{rule.last_hit_at ? new Date(rule.last_hit_at).toLocaleString() : 'Never'}</td>
                     <td className="text-right p-2">
                       <button
                         onClick={() => handleDeleteRule(rule.id)}
@@ -128,7 +153,7 @@ const FirewallPage = () => {
                 ))
               ) : (
                 <tr>
-                  <td colSpan="3" className="text-center p-4">
+                  <td colSpan="7" className="text-center p-4">
                     No firewall rules defined.
                   </td>
                 </tr>
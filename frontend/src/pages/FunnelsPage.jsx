@@ -151,7 +151,7 @@ const FunnelsPage = () => {
                                 </div>
                                 <ol className="list-decimal list-inside mt-2 text-slate-400">
                                     {funnel.steps.map((step, index) => (
-                                        <li key={index}>{step}</li>
+                                        <li key={index}>{typeof step === 'string' ? step : step.value}</li>
                                     ))}
                                 </ol>
                             </div>